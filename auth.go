@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/dimchansky/utfbom"
+)
+
+// Authentication methods accepted by `--auth`.
+const (
+	authAuto   = "auto"
+	authEnv    = "env"
+	authFile   = "file"
+	authMSI    = "msi"
+	authDevice = "device"
+)
+
+const (
+	// msiProbeTimeout bounds the check for a managed identity endpoint when
+	// `--auth` is auto, so that the fallback to device code login is quick
+	// off Azure.
+	msiProbeTimeout = 3 * time.Second
+)
+
+// authorize returns the cloud environment given by `--cloud` or
+// `--cloud-file`, the subscription ID (see resolveSubscription) and an
+// authorizer for the environment's Resource Manager endpoint, obtained using
+// the method given by `--auth`. Waiting for a device code login is abandoned
+// if ctx is cancelled.
+func authorize(ctx context.Context) (*azure.Environment, string, autorest.Authorizer, error) {
+	env, err := environment()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	authorizer, err := newAuthorizer(ctx, env)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	subscriptionID, err := resolveSubscription(ctx, env, authorizer)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return env, subscriptionID, authorizer, nil
+}
+
+// environment returns the cloud environment given on the command line.
+func environment() (*azure.Environment, error) {
+	if *cloudFile == "" {
+		env, err := azure.EnvironmentFromName(*cloud)
+		if err != nil {
+			return nil, err
+		}
+		return &env, nil
+	}
+
+	env, err := azure.EnvironmentFromFile(*cloudFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", *cloudFile, err)
+	}
+
+	switch {
+	case env.ResourceManagerEndpoint == "":
+		return nil, fmt.Errorf("%s: resourceManagerEndpoint is required", *cloudFile)
+	case env.ActiveDirectoryEndpoint == "":
+		return nil, fmt.Errorf("%s: activeDirectoryEndpoint is required", *cloudFile)
+	case env.StorageEndpointSuffix == "":
+		return nil, fmt.Errorf("%s: storageEndpointSuffix is required", *cloudFile)
+	}
+
+	return &env, nil
+}
+
+// newAuthorizer returns an authorizer for env's Resource Manager endpoint
+// using the method given by `--auth`. With auto, this is the first of:
+// credentials in environment variables, the SDK auth file named by
+// AZURE_AUTH_LOCATION, a managed identity, and device code login.
+func newAuthorizer(ctx context.Context, env *azure.Environment) (autorest.Authorizer, error) {
+	switch *authMode {
+	case authEnv:
+		return envAuthorizer(env)
+	case authFile:
+		return fileAuthorizer(env)
+	case authMSI:
+		return msiAuthorizer(ctx, env)
+	case authDevice:
+		return deviceAuthorizer(ctx, env)
+	case authAuto:
+	default:
+		return nil, fmt.Errorf("invalid --auth %q: expected %s, %s, %s, %s or %s", *authMode, authAuto, authEnv, authFile, authMSI, authDevice)
+	}
+
+	if hasEnvCredentials() {
+		return envAuthorizer(env)
+	}
+
+	if os.Getenv("AZURE_AUTH_LOCATION") != "" {
+		return fileAuthorizer(env)
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, msiProbeTimeout)
+	defer cancel()
+
+	authorizer, err := msiAuthorizer(probeCtx, env)
+	if err == nil {
+		return authorizer, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	log.Printf("managed identity unavailable: %v", err)
+
+	return deviceAuthorizer(ctx, env)
+}
+
+// hasEnvCredentials returns true if environment variables hold a client
+// secret, client certificate or username and password.
+func hasEnvCredentials() bool {
+	return os.Getenv("AZURE_CLIENT_SECRET") != "" ||
+		os.Getenv("AZURE_CERTIFICATE_PATH") != "" ||
+		(os.Getenv("AZURE_USERNAME") != "" && os.Getenv("AZURE_PASSWORD") != "")
+}
+
+// envAuthorizer returns an authorizer configured from the same environment
+// variables, and in the same order, as auth.NewAuthorizerFromEnvironment,
+// which itself only knows the cloud named by AZURE_ENVIRONMENT.
+func envAuthorizer(env *azure.Environment) (autorest.Authorizer, error) {
+	var (
+		tenantID            = os.Getenv("AZURE_TENANT_ID")
+		clientID            = os.Getenv("AZURE_CLIENT_ID")
+		clientSecret        = os.Getenv("AZURE_CLIENT_SECRET")
+		certificatePath     = os.Getenv("AZURE_CERTIFICATE_PATH")
+		certificatePassword = os.Getenv("AZURE_CERTIFICATE_PASSWORD")
+		username            = os.Getenv("AZURE_USERNAME")
+		password            = os.Getenv("AZURE_PASSWORD")
+	)
+
+	switch {
+	case clientSecret != "":
+		log.Printf("authenticating as service principal %s with a client secret from the environment", clientID)
+		config := auth.NewClientCredentialsConfig(clientID, clientSecret, tenantID)
+		config.AADEndpoint, config.Resource = env.ActiveDirectoryEndpoint, env.ResourceManagerEndpoint
+		return config.Authorizer()
+
+	case certificatePath != "":
+		log.Printf("authenticating as service principal %s with certificate %s", clientID, certificatePath)
+		config := auth.NewClientCertificateConfig(certificatePath, certificatePassword, clientID, tenantID)
+		config.AADEndpoint, config.Resource = env.ActiveDirectoryEndpoint, env.ResourceManagerEndpoint
+		return config.Authorizer()
+
+	case username != "" && password != "":
+		log.Printf("authenticating as user %s with a password from the environment", username)
+		config := auth.NewUsernamePasswordConfig(username, password, clientID, tenantID)
+		config.AADEndpoint, config.Resource = env.ActiveDirectoryEndpoint, env.ResourceManagerEndpoint
+		return config.Authorizer()
+	}
+
+	return nil, fmt.Errorf("no credentials found in the environment: set AZURE_CLIENT_SECRET, AZURE_CERTIFICATE_PATH or AZURE_USERNAME and AZURE_PASSWORD")
+}
+
+// fileAuthorizer returns an authorizer configured from the SDK auth file (as
+// written by `az ad sp create-for-rbac --sdk-auth`) named by
+// AZURE_AUTH_LOCATION. The file carries its own endpoints, so its Resource
+// Manager endpoint must be that of env.
+func fileAuthorizer(env *azure.Environment) (autorest.Authorizer, error) {
+	path := os.Getenv("AZURE_AUTH_LOCATION")
+	log.Printf("authenticating with auth file %s", path)
+
+	f, err := readAuthFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(strings.TrimSuffix(f.ResourceManagerEndpoint, "/"), strings.TrimSuffix(env.ResourceManagerEndpoint, "/")) {
+		return nil, fmt.Errorf("%s: resourceManagerEndpointUrl %q does not match %q of cloud %s: choose the cloud with --cloud or --cloud-file", path, f.ResourceManagerEndpoint, env.ResourceManagerEndpoint, env.Name)
+	}
+
+	// NewAuthorizerFromFile maps a public cloud base URI to the
+	// corresponding endpoint in the file.
+	return auth.NewAuthorizerFromFile(azure.PublicCloud.ResourceManagerEndpoint)
+}
+
+// msiAuthorizer returns an authorizer using the managed identity of the Azure
+// VM or other resource the tool is running on. A token is obtained
+// immediately, so that an unavailable identity is reported here.
+func msiAuthorizer(ctx context.Context, env *azure.Environment) (autorest.Authorizer, error) {
+	endpoint, err := adal.GetMSIVMEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	spt, err := adal.NewServicePrincipalTokenFromMSI(endpoint, env.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	err = spt.RefreshWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Print("authenticating with managed identity")
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+// sdkAuthFile holds the fields of interest of an SDK auth file.
+type sdkAuthFile struct {
+	SubscriptionID          string `json:"subscriptionId"`
+	ResourceManagerEndpoint string `json:"resourceManagerEndpointUrl"`
+}
+
+// readAuthFile reads the SDK auth file at path, which, like
+// auth.NewAuthorizerFromFile, may be UTF-8 or UTF-16.
+func readAuthFile(path string) (*sdkAuthFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, enc := utfbom.Skip(bytes.NewReader(b))
+	switch enc {
+	case utfbom.UTF16LittleEndian, utfbom.UTF16BigEndian:
+		var order binary.ByteOrder = binary.LittleEndian
+		if enc == utfbom.UTF16BigEndian {
+			order = binary.BigEndian
+		}
+
+		u16 := make([]uint16, len(b)/2-1)
+		err = binary.Read(r, order, &u16)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		b = []byte(string(utf16.Decode(u16)))
+
+	default:
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var f sdkAuthFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &f, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// copyImage recreates the image `--name` as `--target-name` in
+// `--target-resource-group`, which may be in another region. Each of the
+// image's disks is snapshotted and the snapshot copied server-side to a blob
+// in `--target-storage-account`, which must be in the target region; the new
+// image is then created from those blobs, with the source image's tags other
+// than its provenance tags, which are replaced by new ones naming the source
+// image. The snapshots are deleted afterwards, even if the process is
+// interrupted. The target storage account's region and any existing target
+// image are checked before anything is copied: an existing image is only
+// replaced with `--force`, as the copies overwrite the blobs it may have been
+// created from.
+func copyImage() error {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
+	if *targetResourceGroup == "" || *targetStorageAccount == "" {
+		return fmt.Errorf("--target-resource-group and --target-storage-account are required")
+	}
+
+	tname := *targetName
+	if tname == "" {
+		tname = *name
+	}
+	if strings.EqualFold(*targetResourceGroup, *resourceGroup) && strings.EqualFold(tname, *name) {
+		return fmt.Errorf("the target image is the source image")
+	}
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !*skipPermissionCheck {
+		err = checkCopyPermissions(ctx, env, authorizer, subscriptionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	rcli := resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	rcli.Authorizer = authorizer
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+
+	image, err := icli.Get(ctx, *resourceGroup, *name, "")
+	if err != nil {
+		return err
+	}
+	if image.ImageProperties == nil || image.StorageProfile == nil || image.StorageProfile.OsDisk == nil {
+		return fmt.Errorf("image %s has no OS disk", *name)
+	}
+
+	location := *targetLocation
+	if location == "" {
+		group, err := rcli.Get(ctx, *targetResourceGroup)
+		if err != nil {
+			return err
+		}
+		location = *group.Location
+	}
+
+	err = imagecreate.CheckStorageAccountLocation(ctx, env, authorizer, subscriptionID, *targetStorageAccount, location)
+	if err != nil {
+		return err
+	}
+
+	existing, err := icli.Get(ctx, *targetResourceGroup, tname, "")
+	switch {
+	case imagecreate.IsNotFound(err):
+	case err != nil:
+		return err
+	case !*force:
+		return fmt.Errorf("image %s already exists in resource group %s: rerun with --force to replace it", tname, *targetResourceGroup)
+	}
+
+	sp := image.StorageProfile
+	tsp := &compute.ImageStorageProfile{
+		ZoneResilient: sp.ZoneResilient,
+	}
+
+	osDisk := *sp.OsDisk
+	osDisk.BlobURI, err = copyImageDisk(ctx, env, authorizer, subscriptionID, *image.Location, sp.OsDisk.BlobURI, sp.OsDisk.ManagedDisk, sp.OsDisk.Snapshot, tname+"-os")
+	if err != nil {
+		return err
+	}
+	osDisk.ManagedDisk, osDisk.Snapshot = nil, nil
+	tsp.OsDisk = &osDisk
+
+	if sp.DataDisks != nil {
+		dataDisks := make([]compute.ImageDataDisk, 0, len(*sp.DataDisks))
+		for _, d := range *sp.DataDisks {
+			d.BlobURI, err = copyImageDisk(ctx, env, authorizer, subscriptionID, *image.Location, d.BlobURI, d.ManagedDisk, d.Snapshot, fmt.Sprintf("%s-lun%d", tname, *d.Lun))
+			if err != nil {
+				return err
+			}
+			d.ManagedDisk, d.Snapshot = nil, nil
+			dataDisks = append(dataDisks, d)
+		}
+		tsp.DataDisks = &dataDisks
+	}
+
+	// The disks of an image cannot be changed, and its new blobs have the
+	// same URLs as its old ones, so the image is deleted and recreated.
+	if existing.ID != nil {
+		err = deleteImage(ctx, icli, *targetResourceGroup, &existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("creating image %s in %s", tname, location)
+	future, err := icli.CreateOrUpdate(ctx, *targetResourceGroup, tname, compute.Image{
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: tsp,
+		},
+		Location: &location,
+		Tags:     mergeTags(nonProvenanceTags(image.Tags), imagecreate.ProvenanceTags(*image.ID, "", "")),
+	})
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, icli.Client)
+}
+
+// checkCopyPermissions checks that the caller can snapshot the disks of the
+// source image and create the target image from copies of them.
+func checkCopyPermissions(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID string) error {
+	src := imagecreate.Requirement{
+		ResourceGroup: *resourceGroup,
+		Actions: []string{
+			imagecreate.ActionReadImage,
+			imagecreate.ActionWriteSnapshot,
+			imagecreate.ActionDeleteSnapshot,
+			imagecreate.ActionGrantSnapshot,
+			imagecreate.ActionRevokeSnapshot,
+		},
+	}
+
+	target := imagecreate.Requirement{
+		ResourceGroup: *targetResourceGroup,
+		Actions:       []string{imagecreate.ActionReadImage, imagecreate.ActionWriteImage},
+	}
+	if *targetLocation == "" {
+		target.Actions = append(target.Actions, imagecreate.ActionReadResourceGroup)
+	}
+	if *force {
+		target.Actions = append(target.Actions, imagecreate.ActionDeleteImage)
+	}
+
+	return imagecreate.CheckPermissions(ctx, env, authorizer, subscriptionID, []imagecreate.Requirement{
+		src,
+		target,
+		{StorageAccount: *targetStorageAccount, Actions: []string{imagecreate.ActionListStorageKeys}},
+	})
+}
+
+// copyImageDisk snapshots the image disk with the given source (exactly one of
+// blobURI, managedDisk and snapshot is set) in the source resource group and
+// copies the snapshot to the blob named name in the target storage account,
+// returning the blob's URL. The snapshot is deleted afterwards.
+func copyImageDisk(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, location string, blobURI *string, managedDisk, snapshot *compute.SubResource, name string) (*string, error) {
+	scli := compute.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	scli.Authorizer = authorizer
+
+	creationData := &compute.CreationData{
+		CreateOption: compute.Copy,
+	}
+	switch {
+	case blobURI != nil:
+		creationData.CreateOption = compute.Import
+		creationData.SourceURI = blobURI
+	case managedDisk != nil:
+		creationData.SourceResourceID = managedDisk.ID
+	case snapshot != nil:
+		creationData.SourceResourceID = snapshot.ID
+	default:
+		return nil, fmt.Errorf("image disk %s has no source", name)
+	}
+
+	temp := &tempSnapshot{
+		scli:          scli,
+		resourceGroup: *resourceGroup,
+		name:          fmt.Sprintf("%s-copy-%d", name, time.Now().Unix()),
+	}
+
+	// As in export, cleanup uses a fresh context and is deferred first.
+	defer deleteTempDisk(context.Background(), temp)
+
+	log.Printf("creating temporary %s", temp)
+	future, err := scli.CreateOrUpdate(ctx, temp.resourceGroup, temp.name, compute.Snapshot{
+		DiskProperties: &compute.DiskProperties{
+			CreationData: creationData,
+		},
+		Location: &location,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = future.WaitForCompletion(ctx, scli.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	defer revokeReadAccess(context.Background(), temp)
+	sasURL, err := grantReadAccess(ctx, temp)
+	if err != nil {
+		return nil, err
+	}
+
+	u := imagecreate.BlobURL(env, *targetStorageAccount, *targetContainer, name+".vhd")
+
+	b, err := imagecreate.GetBlob(ctx, env, authorizer, subscriptionID, u)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.Container.CreateIfNotExists(&storage.CreateContainerOptions{Access: storage.ContainerAccessTypePrivate})
+	if err != nil {
+		return nil, err
+	}
+
+	err = imagecreate.CopyBlob(ctx, b, sasURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// parseDataDisk parses a comma separated list of key=value pairs describing
+// a data disk. lun and source are required.
+func parseDataDisk(s string) (*imagecreate.DataDisk, error) {
+	d := &imagecreate.DataDisk{Lun: -1}
+	var err error
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: expected key=value, found %q", s, kv)
+		}
+
+		switch parts[0] {
+		case "lun":
+			var lun int64
+			lun, err = strconv.ParseInt(parts[1], 10, 32)
+			if err != nil || lun < 0 {
+				return nil, fmt.Errorf("%s: invalid lun %q", s, parts[1])
+			}
+			d.Lun = int32(lun)
+		case "source":
+			d.Source = parts[1]
+		case "caching":
+			d.Caching, err = imagecreate.ParseCachingType(parts[1])
+		case "disk-size-gb":
+			var size int64
+			size, err = strconv.ParseInt(parts[1], 10, 32)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("%s: invalid disk-size-gb %q", s, parts[1])
+			}
+			d.DiskSizeGB = int32(size)
+		case "storage-account-type":
+			d.StorageAccountType, err = imagecreate.ParseStorageAccountType(parts[1])
+		default:
+			return nil, fmt.Errorf("%s: unknown key %q", s, parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+	}
+
+	if d.Lun == -1 {
+		return nil, fmt.Errorf("%s: lun is required", s)
+	}
+	if d.Source == "" {
+		return nil, fmt.Errorf("%s: source is required", s)
+	}
+
+	return d, nil
+}
+
+// parseDataDisks parses the given `--data-disk` flags, checking that their
+// LUNs are unique.
+func parseDataDisks(flags []string) ([]imagecreate.DataDisk, error) {
+	luns := map[int32]struct{}{}
+	dds := make([]imagecreate.DataDisk, 0, len(flags))
+
+	for _, flag := range flags {
+		d, err := parseDataDisk(flag)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, found := luns[d.Lun]; found {
+			return nil, fmt.Errorf("duplicate data disk lun %d", d.Lun)
+		}
+		luns[d.Lun] = struct{}{}
+
+		dds = append(dds, *d)
+	}
+
+	return dds, nil
+}
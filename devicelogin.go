@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	// Device code login uses the Azure CLI's public client unless
+	// AZURE_CLIENT_ID is set, and the user's home tenant unless
+	// AZURE_TENANT_ID is set.
+	deviceClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+	deviceTenantID = "common"
+)
+
+// deviceAuthorizer returns an authorizer obtained by interactive device code
+// login. Tokens are cached per tenant (see tokenCachePath) and refreshed as
+// needed using the cached refresh token, so that the user only has to sign
+// in again once that expires or is revoked. Waiting for the user to sign in is
+// abandoned if ctx is cancelled.
+func deviceAuthorizer(ctx context.Context, env *azure.Environment) (autorest.Authorizer, error) {
+	clientID, tenantID := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_TENANT_ID")
+	if clientID == "" {
+		clientID = deviceClientID
+	}
+	if tenantID == "" {
+		tenantID = deviceTenantID
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := tokenCachePath(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	save := func(token adal.Token) error {
+		cacheToken(path, token)
+		return nil
+	}
+
+	if _, err = os.Stat(path); err == nil {
+		spt, err := cachedToken(oauthConfig, clientID, env.ResourceManagerEndpoint, path, save)
+		if err == nil {
+			log.Printf("authenticating with cached device code login to tenant %s", tenantID)
+			return autorest.NewBearerAuthorizer(spt), nil
+		}
+		log.Printf("cached login to tenant %s is unusable: %v", tenantID, err)
+	}
+
+	log.Printf("authenticating with device code login to tenant %s", tenantID)
+
+	sender := adal.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		return http.DefaultClient.Do(req.WithContext(ctx))
+	})
+	code, err := adal.InitiateDeviceAuth(sender, *oauthConfig, clientID, env.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Print(*code.Message)
+
+	token, err := waitForDeviceAuth(ctx, sender, code)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheToken(path, *token)
+
+	spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, clientID, env.ResourceManagerEndpoint, *token, save)
+	if err != nil {
+		return nil, err
+	}
+
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+// waitForDeviceAuth polls for the completion of a device code login like
+// adal.WaitForUserCompletion, but stops when ctx is cancelled.
+func waitForDeviceAuth(ctx context.Context, sender adal.Sender, code *adal.DeviceCode) (*adal.Token, error) {
+	interval := time.Duration(*code.Interval) * time.Second
+	wait := interval
+
+	for {
+		token, err := adal.CheckForUserCompletion(sender, code)
+		switch err {
+		case nil:
+			return token, nil
+		case adal.ErrDeviceAuthorizationPending:
+		case adal.ErrDeviceSlowDown:
+			wait += wait
+			if wait > 3*interval {
+				return nil, fmt.Errorf("waiting for device code login: told to slow down too often")
+			}
+		default:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// cachedToken returns a token for resource loaded from the cache file at
+// path, refreshing it first if it has expired. save is called with any
+// refreshed token.
+func cachedToken(oauthConfig *adal.OAuthConfig, clientID, resource, path string, save adal.TokenRefreshCallback) (*adal.ServicePrincipalToken, error) {
+	token, err := adal.LoadToken(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cache is per tenant, not per cloud.
+	if token.Resource != resource {
+		return nil, fmt.Errorf("token is for %s", token.Resource)
+	}
+
+	spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, clientID, resource, *token, save)
+	if err != nil {
+		return nil, err
+	}
+
+	err = spt.EnsureFresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return spt, nil
+}
+
+// cacheToken writes token to the cache file at path, readable only by the
+// user. Failure is logged but otherwise ignored, as the token remains usable.
+func cacheToken(path string, token adal.Token) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = adal.SaveToken(path, 0600, token)
+	}
+	if err != nil {
+		log.Printf("caching login: %v", err)
+	}
+}
+
+// tokenCacheDir returns the directory in which device code login tokens are
+// cached, under the user's configuration directory.
+func tokenCacheDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "azure-image-create", "tokens"), nil
+}
+
+// tokenCachePath returns the path of the cached device code login token for
+// tenantID.
+func tokenCachePath(tenantID string) (string, error) {
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, tenantID+".json"), nil
+}
+
+// logout deletes all cached device code login tokens.
+func logout() error {
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("removed cached logins from %s", dir)
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// export does the reverse of run: it creates a temporary managed disk from
+// the image `--name`, obtains a read SAS for it and streams the VHD to
+// `--destination`, which may be a local file or a blob URL. The SAS is always
+// revoked and the temporary disk deleted afterwards, even if the process is
+// interrupted.
+func export() error {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
+	if *destination == "" {
+		return fmt.Errorf("--destination is required")
+	}
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !*skipPermissionCheck {
+		err = checkExportPermissions(ctx, env, authorizer, subscriptionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+	dcli := compute.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	dcli.Authorizer = authorizer
+
+	image, err := icli.Get(ctx, *resourceGroup, *name, "")
+	if err != nil {
+		return err
+	}
+
+	disk := &tempManagedDisk{
+		dcli:          dcli,
+		resourceGroup: *resourceGroup,
+		name:          fmt.Sprintf("%s-export-%d", *name, time.Now().Unix()),
+	}
+
+	// Cleanup uses a fresh context so that it still runs once ctx is
+	// cancelled, and is deferred first in case the disk is created although
+	// the request fails.
+	defer deleteTempDisk(context.Background(), disk)
+
+	log.Printf("creating temporary %s", disk)
+	future, err := dcli.CreateOrUpdate(ctx, disk.resourceGroup, disk.name, compute.Disk{
+		DiskProperties: &compute.DiskProperties{
+			CreationData: &compute.CreationData{
+				CreateOption: compute.FromImage,
+				ImageReference: &compute.ImageDiskReference{
+					ID: image.ID,
+				},
+			},
+		},
+		Location: image.Location,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = future.WaitForCompletion(ctx, dcli.Client)
+	if err != nil {
+		return err
+	}
+
+	defer revokeReadAccess(context.Background(), disk)
+	sasURL, err := grantReadAccess(ctx, disk)
+	if err != nil {
+		return err
+	}
+
+	if imagecreate.IsBlobURL(*destination) {
+		b, err := imagecreate.GetBlob(ctx, env, authorizer, subscriptionID, *destination)
+		if err != nil {
+			return err
+		}
+
+		return imagecreate.CopyBlob(ctx, b, sasURL)
+	}
+
+	return download(ctx, sasURL, *destination)
+}
+
+// checkExportPermissions checks that the caller can create a temporary disk
+// from the image and read it and, if `--destination` is a blob URL, write to
+// it with the storage account key.
+func checkExportPermissions(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID string) error {
+	reqs := []imagecreate.Requirement{
+		{
+			ResourceGroup: *resourceGroup,
+			Actions: []string{
+				imagecreate.ActionReadImage,
+				imagecreate.ActionWriteDisk,
+				imagecreate.ActionDeleteDisk,
+				imagecreate.ActionGrantDisk,
+				imagecreate.ActionRevokeDisk,
+			},
+		},
+	}
+
+	if imagecreate.IsBlobURL(*destination) {
+		u, err := url.Parse(*destination)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, imagecreate.Requirement{StorageAccount: strings.SplitN(u.Host, ".", 2)[0], Actions: []string{imagecreate.ActionListStorageKeys}})
+	}
+
+	return imagecreate.CheckPermissions(ctx, env, authorizer, subscriptionID, reqs)
+}
+
+// download streams the content at url to the local file at path, logging
+// progress, until ctx is cancelled.
+func download(ctx context.Context, url, path string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading disk: unexpected status %q", resp.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	p := imagecreate.NewProgress("downloading to "+path, resp.ContentLength)
+	_, err = io.Copy(f, io.TeeReader(resp.Body, p))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p.Finish()
+
+	return f.Close()
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// Output formats accepted by `--output`.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// list prints the images in `--resource-group`.
+func list() error {
+	ctx := context.Background()
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+
+	images, err := listImages(ctx, icli, *resourceGroup)
+	if err != nil {
+		return err
+	}
+
+	return printImages(images)
+}
+
+// show prints the image `--name`.
+func show() error {
+	ctx := context.Background()
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+
+	image, err := icli.Get(ctx, *resourceGroup, *name, "")
+	if err != nil {
+		return err
+	}
+
+	if *output == outputJSON {
+		return printJSON(image)
+	}
+
+	return printImages([]compute.Image{image})
+}
+
+// deleteCommand deletes the image `--name` after confirmation, and with
+// `--delete-blobs` its source blobs; see deleteImages.
+func deleteCommand() error {
+	ctx := context.Background()
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+
+	image, err := icli.Get(ctx, *resourceGroup, *name, "")
+	if err != nil {
+		return err
+	}
+
+	if !*skipPermissionCheck {
+		err = checkDeletePermissions(ctx, env, authorizer, subscriptionID, *resourceGroup, []compute.Image{image})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !*dryRun && !confirm(fmt.Sprintf("delete image %s in resource group %s?", *name, *resourceGroup)) {
+		return fmt.Errorf("not confirmed")
+	}
+
+	return deleteImages(ctx, env, authorizer, subscriptionID, icli, *resourceGroup, []compute.Image{image})
+}
+
+// prune deletes the images in `--resource-group` selected by selectPrunable
+// after confirmation; see deleteImages. At least one of `--prefix` and
+// `--match-tag` is required, so that unrelated images are not pruned by
+// accident.
+func prune() error {
+	ctx := context.Background()
+
+	if *keep < 0 {
+		return fmt.Errorf("invalid keep %d", *keep)
+	}
+
+	want, err := parseMatchTags(*matchTags)
+	if err != nil {
+		return err
+	}
+
+	if *prefix == "" && len(want) == 0 {
+		return fmt.Errorf("prune requires --prefix or --match-tag")
+	}
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	icli := compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	icli.Authorizer = authorizer
+
+	images, err := listImages(ctx, icli, *resourceGroup)
+	if err != nil {
+		return err
+	}
+
+	candidates, undated := selectPrunable(images, *prefix, want, *keep)
+	for _, image := range undated {
+		log.Printf("skipping image %s: it has no valid %s tag", *image.Name, imagecreate.TagCreatedAt)
+	}
+	if len(candidates) == 0 {
+		log.Printf("nothing to prune")
+		return nil
+	}
+
+	names := make([]string, 0, len(candidates))
+	for _, image := range candidates {
+		names = append(names, *image.Name)
+	}
+
+	if !*skipPermissionCheck {
+		err = checkDeletePermissions(ctx, env, authorizer, subscriptionID, *resourceGroup, candidates)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !*dryRun && !confirm(fmt.Sprintf("delete %d images in resource group %s: %s?", len(names), *resourceGroup, strings.Join(names, ", "))) {
+		return fmt.Errorf("not confirmed")
+	}
+
+	return deleteImages(ctx, env, authorizer, subscriptionID, icli, *resourceGroup, candidates)
+}
+
+// selectPrunable returns the images to prune: those which match prefix and
+// tags, except for the keep newest. Age is taken from the creation time
+// provenance tag, so matching images without a valid one, which were not
+// created by this tool, are never pruned; they are returned separately.
+func selectPrunable(images []compute.Image, prefix string, tags map[string]*string, keep int) (prunable, undated []compute.Image) {
+	type dated struct {
+		image     compute.Image
+		createdAt time.Time
+	}
+
+	var candidates []dated
+	for _, image := range images {
+		if !strings.HasPrefix(to.String(image.Name), prefix) || !hasTags(image.Tags, tags) {
+			continue
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, to.String(image.Tags[imagecreate.TagCreatedAt]))
+		if err != nil {
+			undated = append(undated, image)
+			continue
+		}
+		candidates = append(candidates, dated{image: image, createdAt: createdAt})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].createdAt.After(candidates[j].createdAt)
+	})
+
+	for i := keep; i < len(candidates); i++ {
+		prunable = append(prunable, candidates[i].image)
+	}
+
+	return prunable, undated
+}
+
+// listImages returns all the images in resourceGroup, or in the subscription
+// if resourceGroup is empty.
+func listImages(ctx context.Context, icli compute.ImagesClient, resourceGroup string) ([]compute.Image, error) {
+	var images []compute.Image
+
+	var it compute.ImageListResultIterator
+	var err error
+	if resourceGroup == "" {
+		it, err = icli.ListComplete(ctx)
+	} else {
+		it, err = icli.ListByResourceGroupComplete(ctx, resourceGroup)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for it.NotDone() {
+		images = append(images, it.Value())
+
+		err = it.Next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return images, nil
+}
+
+// deleteImages deletes images from resourceGroup and, with `--delete-blobs`,
+// the blobs their disks were created from. A blob still used by any other
+// image in the subscription, including one which failed to delete, is kept.
+// Blobs are deleted only once the images are gone, and a failure to delete one
+// image or blob does not stop the others. With `--dry-run`, what would be
+// deleted is logged instead.
+func deleteImages(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID string, icli compute.ImagesClient, resourceGroup string, images []compute.Image) error {
+	// others holds the images whose blobs must not be deleted.
+	var others []compute.Image
+	if *deleteBlobs {
+		all, err := listImages(ctx, icli, "")
+		if err != nil {
+			return err
+		}
+		others = excludeImages(all, images)
+	}
+
+	var deleted []compute.Image
+	var failed int
+	for i := range images {
+		if *dryRun {
+			log.Printf("would delete image %s", *images[i].Name)
+			deleted = append(deleted, images[i])
+			continue
+		}
+
+		err := deleteImage(ctx, icli, resourceGroup, &images[i])
+		if err != nil {
+			log.Printf("deleting image %s: %v", *images[i].Name, err)
+			others = append(others, images[i])
+			failed++
+			continue
+		}
+		deleted = append(deleted, images[i])
+	}
+
+	var blobsFailed int
+	if *deleteBlobs {
+		unused, used := unusedBlobs(deleted, others)
+		for _, blobURL := range used {
+			log.Printf("keeping blob %s: it is used by another image", blobURL)
+		}
+
+		for _, blobURL := range unused {
+			if *dryRun {
+				log.Printf("would delete blob %s", blobURL)
+				continue
+			}
+
+			err := deleteBlob(ctx, env, authorizer, subscriptionID, blobURL)
+			if err != nil {
+				log.Printf("deleting blob %s: %v", blobURL, err)
+				blobsFailed++
+			}
+		}
+	}
+
+	switch {
+	case failed > 0:
+		return fmt.Errorf("%d of %d images could not be deleted", failed, len(images))
+	case blobsFailed > 0:
+		return fmt.Errorf("%d blobs could not be deleted", blobsFailed)
+	}
+
+	return nil
+}
+
+// checkDeletePermissions checks that the caller can delete images from
+// resourceGroup and, with `--delete-blobs`, delete their blobs with the storage
+// account keys. Listing the subscription's images to find blobs still in use
+// cannot be checked at resource group scope; deleteImages does it before
+// deleting anything.
+func checkDeletePermissions(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, resourceGroup string, images []compute.Image) error {
+	reqs := []imagecreate.Requirement{
+		{
+			ResourceGroup: resourceGroup,
+			Actions:       []string{imagecreate.ActionReadImage, imagecreate.ActionDeleteImage},
+		},
+	}
+
+	if *deleteBlobs {
+		accounts := map[string]bool{}
+		for i := range images {
+			for _, blobURL := range imageBlobURLs(&images[i]) {
+				u, err := url.Parse(blobURL)
+				if err != nil {
+					return err
+				}
+				account := strings.ToLower(strings.SplitN(u.Host, ".", 2)[0])
+				if !accounts[account] {
+					accounts[account] = true
+					reqs = append(reqs, imagecreate.Requirement{StorageAccount: account, Actions: []string{imagecreate.ActionListStorageKeys}})
+				}
+			}
+		}
+	}
+
+	return imagecreate.CheckPermissions(ctx, env, authorizer, subscriptionID, reqs)
+}
+
+// excludeImages returns the images in all which are not in images, comparing
+// resource IDs case-insensitively.
+func excludeImages(all, images []compute.Image) []compute.Image {
+	exclude := map[string]bool{}
+	for _, image := range images {
+		exclude[strings.ToLower(to.String(image.ID))] = true
+	}
+
+	var result []compute.Image
+	for _, image := range all {
+		if !exclude[strings.ToLower(to.String(image.ID))] {
+			result = append(result, image)
+		}
+	}
+	return result
+}
+
+// unusedBlobs returns the blobs of deleted's disks which are not used by any
+// of others, each once, and separately those which are. Blob URLs are compared
+// case-insensitively.
+func unusedBlobs(deleted, others []compute.Image) (unused, used []string) {
+	keep := map[string]bool{}
+	for i := range others {
+		for _, blobURL := range imageBlobURLs(&others[i]) {
+			keep[strings.ToLower(blobURL)] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range deleted {
+		for _, blobURL := range imageBlobURLs(&deleted[i]) {
+			if seen[strings.ToLower(blobURL)] {
+				continue
+			}
+			seen[strings.ToLower(blobURL)] = true
+
+			if keep[strings.ToLower(blobURL)] {
+				used = append(used, blobURL)
+			} else {
+				unused = append(unused, blobURL)
+			}
+		}
+	}
+
+	return unused, used
+}
+
+func deleteImage(ctx context.Context, icli compute.ImagesClient, resourceGroup string, image *compute.Image) error {
+	log.Printf("deleting image %s", *image.Name)
+	future, err := icli.Delete(ctx, resourceGroup, *image.Name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, icli.Client)
+}
+
+func deleteBlob(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, blobURL string) error {
+	log.Printf("deleting blob %s", blobURL)
+
+	b, err := imagecreate.GetBlob(ctx, env, authorizer, subscriptionID, blobURL)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.DeleteIfExists(nil)
+	return err
+}
+
+// imageBlobURLs returns the blob URLs of image's disks.
+func imageBlobURLs(image *compute.Image) []string {
+	var urls []string
+
+	if image.ImageProperties == nil || image.StorageProfile == nil {
+		return nil
+	}
+
+	if image.StorageProfile.OsDisk != nil && image.StorageProfile.OsDisk.BlobURI != nil {
+		urls = append(urls, *image.StorageProfile.OsDisk.BlobURI)
+	}
+
+	if image.StorageProfile.DataDisks != nil {
+		for _, d := range *image.StorageProfile.DataDisks {
+			if d.BlobURI != nil {
+				urls = append(urls, *d.BlobURI)
+			}
+		}
+	}
+
+	return urls
+}
+
+// hasTags returns true if tags includes each of want.
+func hasTags(tags, want map[string]*string) bool {
+	for k, v := range want {
+		if to.String(tags[k]) != *v {
+			return false
+		}
+	}
+	return true
+}
+
+// printImages prints images in the format given by `--output`.
+func printImages(images []compute.Image) error {
+	switch *output {
+	case outputJSON:
+		if images == nil {
+			images = []compute.Image{}
+		}
+		return printJSON(images)
+
+	case outputTable:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tLOCATION\tOS TYPE\tSTATE\tCREATED")
+		for _, image := range images {
+			var osType compute.OperatingSystemTypes
+			var state string
+			if image.ImageProperties != nil {
+				if image.StorageProfile != nil && image.StorageProfile.OsDisk != nil {
+					osType = image.StorageProfile.OsDisk.OsType
+				}
+				state = to.String(image.ProvisioningState)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", to.String(image.Name), to.String(image.Location), osType, state, to.String(image.Tags[imagecreate.TagCreatedAt]))
+		}
+		return w.Flush()
+	}
+
+	return fmt.Errorf("invalid output %q", *output)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Printf("%s\n", b)
+	return err
+}
+
+// confirm asks the user the given question on stderr and returns true if they
+// answer yes. It returns true without asking if `--yes` is set.
+func confirm(question string) bool {
+	if *yes {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
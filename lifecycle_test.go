@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+func testImage(name, createdAt string, tags map[string]*string, blobs ...string) compute.Image {
+	image := compute.Image{
+		ID:   to.StringPtr("/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/images/" + name),
+		Name: to.StringPtr(name),
+		Tags: map[string]*string{},
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{},
+		},
+	}
+	if createdAt != "" {
+		image.Tags[imagecreate.TagCreatedAt] = to.StringPtr(createdAt)
+	}
+	for k, v := range tags {
+		image.Tags[k] = v
+	}
+
+	if len(blobs) > 0 {
+		image.StorageProfile.OsDisk = &compute.ImageOSDisk{BlobURI: to.StringPtr(blobs[0])}
+	}
+	if len(blobs) > 1 {
+		var dataDisks []compute.ImageDataDisk
+		for i, blob := range blobs[1:] {
+			dataDisks = append(dataDisks, compute.ImageDataDisk{Lun: to.Int32Ptr(int32(i)), BlobURI: to.StringPtr(blob)})
+		}
+		image.StorageProfile.DataDisks = &dataDisks
+	}
+
+	return image
+}
+
+func imageNames(images []compute.Image) []string {
+	var names []string
+	for _, image := range images {
+		names = append(names, *image.Name)
+	}
+	return names
+}
+
+func TestSelectPrunable(t *testing.T) {
+	prod := map[string]*string{"env": to.StringPtr("prod")}
+
+	images := []compute.Image{
+		testImage("app-1", "2018-01-01T00:00:00Z", prod),
+		testImage("app-3", "2018-03-01T00:00:00Z", prod),
+		testImage("app-2", "2018-02-01T00:00:00Z", nil),
+		testImage("app-4", "2018-04-01T00:00:00Z", prod),
+		testImage("app-manual", "", prod),
+		testImage("app-bad", "yesterday", nil),
+		testImage("other-1", "2017-01-01T00:00:00Z", prod),
+	}
+
+	for _, tt := range []struct {
+		name        string
+		prefix      string
+		tags        map[string]*string
+		keep        int
+		wantPrune   []string
+		wantUndated []string
+	}{
+		{
+			name:        "prefix",
+			prefix:      "app-",
+			keep:        2,
+			wantPrune:   []string{"app-2", "app-1"},
+			wantUndated: []string{"app-manual", "app-bad"},
+		},
+		{
+			name:        "tags",
+			tags:        prod,
+			keep:        1,
+			wantPrune:   []string{"app-3", "app-1", "other-1"},
+			wantUndated: []string{"app-manual"},
+		},
+		{
+			name:        "prefix and tags",
+			prefix:      "app-",
+			tags:        prod,
+			wantPrune:   []string{"app-4", "app-3", "app-1"},
+			wantUndated: []string{"app-manual"},
+		},
+		{
+			name:        "keep all",
+			prefix:      "app-",
+			keep:        4,
+			wantUndated: []string{"app-manual", "app-bad"},
+		},
+		{
+			name:   "no match",
+			prefix: "none-",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			prunable, undated := selectPrunable(images, tt.prefix, tt.tags, tt.keep)
+			if got := imageNames(prunable); !reflect.DeepEqual(got, tt.wantPrune) {
+				t.Errorf("got prunable %v, expected %v", got, tt.wantPrune)
+			}
+			if got := imageNames(undated); !reflect.DeepEqual(got, tt.wantUndated) {
+				t.Errorf("got undated %v, expected %v", got, tt.wantUndated)
+			}
+		})
+	}
+}
+
+func TestUnusedBlobs(t *testing.T) {
+	const (
+		a = "https://account.blob.core.windows.net/vhds/a.vhd"
+		b = "https://account.blob.core.windows.net/vhds/b.vhd"
+		c = "https://account.blob.core.windows.net/vhds/c.vhd"
+	)
+
+	for _, tt := range []struct {
+		name       string
+		deleted    []compute.Image
+		others     []compute.Image
+		wantUnused []string
+		wantUsed   []string
+	}{
+		{
+			name:       "unused",
+			deleted:    []compute.Image{testImage("1", "", nil, a, b)},
+			wantUnused: []string{a, b},
+		},
+		{
+			name:       "used by another image",
+			deleted:    []compute.Image{testImage("1", "", nil, a, b)},
+			others:     []compute.Image{testImage("2", "", nil, c, b)},
+			wantUnused: []string{a},
+			wantUsed:   []string{b},
+		},
+		{
+			name:     "used with different case",
+			deleted:  []compute.Image{testImage("1", "", nil, a)},
+			others:   []compute.Image{testImage("2", "", nil, "https://ACCOUNT.blob.core.windows.net/vhds/a.vhd")},
+			wantUsed: []string{a},
+		},
+		{
+			name:       "shared by deleted images",
+			deleted:    []compute.Image{testImage("1", "", nil, a), testImage("2", "", nil, a, c)},
+			wantUnused: []string{a, c},
+		},
+		{
+			name:    "no blobs",
+			deleted: []compute.Image{testImage("1", "", nil)},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unused, used := unusedBlobs(tt.deleted, tt.others)
+			if !reflect.DeepEqual(unused, tt.wantUnused) {
+				t.Errorf("got unused %v, expected %v", unused, tt.wantUnused)
+			}
+			if !reflect.DeepEqual(used, tt.wantUsed) {
+				t.Errorf("got used %v, expected %v", used, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestExcludeImages(t *testing.T) {
+	all := []compute.Image{testImage("1", "", nil), testImage("2", "", nil), testImage("3", "", nil)}
+
+	deleting := testImage("2", "", nil)
+	deleting.ID = to.StringPtr("/SUBSCRIPTIONS/s/resourcegroups/RG/providers/Microsoft.Compute/images/2")
+
+	if got := imageNames(excludeImages(all, []compute.Image{deleting})); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("got %v", got)
+	}
+}
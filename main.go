@@ -2,70 +2,248 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/spf13/pflag"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
 )
 
 var (
 	resourceGroup      = pflag.StringP("resource-group", "g", "", "resource group")
 	name               = pflag.StringP("name", "n", "", "image")
-	source             = pflag.StringP("source", "", "", "source")
+	source             = pflag.StringP("source", "", "", "source: blob URL, or managed disk or snapshot name or resource ID")
+	file               = pflag.StringP("file", "", "", "local disk image to upload to --source before creating the image")
+	format             = pflag.StringP("format", "", imagecreate.FormatAuto, "format of --file: auto, vhd, raw or qcow2; raw and qcow2 images are converted to fixed VHD")
+	concurrency        = pflag.IntP("concurrency", "", 8, "number of 4MiB page ranges to upload in parallel, at most 64")
+	resume             = pflag.BoolP("resume", "", false, "resume a previously interrupted upload of --file")
+	dataDisks          = pflag.StringArrayP("data-disk", "", nil, "data disk as lun=LUN,source=SOURCE[,caching=CACHING][,disk-size-gb=SIZE][,storage-account-type=TYPE]; SOURCE is as for --source; repeatable")
+	sourceVM           = pflag.StringP("source-vm", "", "", "capture the image from this generalized virtual machine (name or resource ID) instead of --source")
+	deallocate         = pflag.BoolP("deallocate", "", false, "deallocate --source-vm if it is running")
+	generalize         = pflag.BoolP("generalize", "", false, "deallocate and generalize --source-vm if necessary")
 	osType             = pflag.StringP("os-type", "", "", "os-type")
+	osState            = pflag.StringP("os-state", "", "", "os-state: Generalized or Specialized")
+	caching            = pflag.StringP("caching", "", "", "OS disk caching: None, ReadOnly or ReadWrite")
+	diskSizeGB         = pflag.Int32P("disk-size-gb", "", 0, "OS disk size in GB, if larger than the source")
+	zoneResilient      = pflag.BoolP("zone-resilient", "", false, "create a zone resilient image")
+	tags               = pflag.StringArrayP("tag", "", nil, "tag to set on the image as key=value, in addition to provenance tags; repeatable")
+	force              = pflag.BoolP("force", "", false, "replace an existing image whose disk sources differ; copy: replace an existing target image")
+	dryRun             = pflag.BoolP("dry-run", "", false, "validate inputs and print the request which would create or update the image, without making any changes; delete, prune: log what would be deleted")
 	storageAccountType = pflag.StringP("storage-account-type", "", "", "storage-account-type")
+	destination        = pflag.StringP("destination", "", "", "export: local file or blob URL to write the image's OS disk VHD to")
+
+	targetResourceGroup  = pflag.StringP("target-resource-group", "", "", "copy: resource group to create the copied image in")
+	targetLocation       = pflag.StringP("target-location", "", "", "copy: region to create the copied image in (default: that of --target-resource-group)")
+	targetName           = pflag.StringP("target-name", "", "", "copy: name of the copied image (default: --name)")
+	targetStorageAccount = pflag.StringP("target-storage-account", "", "", "copy: storage account in the target region to copy VHDs to")
+	targetContainer      = pflag.StringP("target-container", "", "images", "copy, publish: container in the target storage account to copy VHDs to")
+
+	publishTargets = pflag.StringArrayP("publish-target", "", nil, "publish: target as resource-group=RG,storage-account=ACCOUNT[,subscription=SUBSCRIPTION][,location=LOCATION]; ACCOUNT must be in the target region; repeatable")
+	parallelism    = pflag.IntP("parallelism", "", 4, "publish: number of targets to publish to in parallel")
+
+	manifestFile = pflag.StringP("manifest", "", "", "apply: YAML or JSON file describing the images to create")
+
+	output      = pflag.StringP("output", "o", outputTable, "list, show: output format: table or json")
+	yes         = pflag.BoolP("yes", "y", false, "delete, prune: do not ask for confirmation")
+	deleteBlobs = pflag.BoolP("delete-blobs", "", false, "delete, prune: also delete the source blobs of deleted images, unless used by other images")
+	keep        = pflag.IntP("keep", "", 3, "prune: number of newest matching images to keep")
+	prefix      = pflag.StringP("prefix", "", "", "prune: only consider images whose names start with this prefix; --prefix or --match-tag is required")
+	matchTags   = pflag.StringArrayP("match-tag", "", nil, "prune: only consider images with this tag, as key=value; repeatable")
+
+	stagingStorageAccount = pflag.StringP("staging-storage-account", "", "", "server-side copy blob sources from any readable URL (e.g. with a SAS token) into this storage account before creating the image")
+	stagingContainer      = pflag.StringP("staging-container", "", "staging", "container in --staging-storage-account to copy blob sources to")
+
+	cloud               = pflag.StringP("cloud", "", azure.PublicCloud.Name, "Azure cloud: AzurePublicCloud, AzureUSGovernmentCloud, AzureChinaCloud or AzureGermanCloud")
+	cloudFile           = pflag.StringP("cloud-file", "", "", "JSON file describing the endpoints of a custom Azure cloud, used instead of --cloud")
+	subscription        = pflag.StringP("subscription", "", "", "subscription ID (default: AZURE_SUBSCRIPTION_ID, else the auth file's subscriptionId, else the only subscription accessible)")
+	skipPermissionCheck = pflag.BoolP("skip-permission-check", "", false, "create, apply, copy, publish, export, delete, prune: do not check the caller's permissions before starting")
+	authMode            = pflag.StringP("auth", "", authAuto, "authentication method: env, file (AZURE_AUTH_LOCATION), msi or device; auto tries each in that order; device code logins are cached until logout")
 )
 
-// run does the same as `az image create -g $RESOURCEGROUP -n $IMAGE --source
-// https://$STORAGEACCOUNT.blob.core.windows.net/$CONTAINER/$IMAGE.vhd --os-type
-// $OSTYPE` but adds an additional argument `--storage-account-type`.
-// `az image create` doesn't appear to allow controlling the SLA of the
-// underlying disk.
-func run() (err error) {
-	ctx := context.Background()
+// run creates or updates the image described by the command line flags; see
+// imagecreate.ImageCreator.Create.
+func run() error {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
 
-	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	opts, err := createOptions()
+	if err != nil {
+		return err
+	}
 
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	env, subscriptionID, authorizer, err := authorize(ctx)
 	if err != nil {
 		return err
 	}
 
-	rcli := resources.NewGroupsClient(subscriptionID)
-	rcli.Authorizer = authorizer
-	icli := compute.NewImagesClient(subscriptionID)
-	icli.Authorizer = authorizer
+	_, err = imagecreate.New(env, subscriptionID, authorizer, *opts).Create(ctx)
+	return err
+}
 
-	group, err := rcli.Get(ctx, *resourceGroup)
+// createOptions returns the image creation options given on the command line.
+func createOptions() (*imagecreate.Options, error) {
+	osDisk, err := imageOSDisk()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	future, err := icli.CreateOrUpdate(ctx, *resourceGroup, *name, compute.Image{
-		ImageProperties: &compute.ImageProperties{
-			StorageProfile: &compute.ImageStorageProfile{
-				OsDisk: &compute.ImageOSDisk{
-					OsType:             compute.OperatingSystemTypes(*osType),
-					BlobURI:            source,
-					StorageAccountType: compute.StorageAccountTypes(*storageAccountType),
-				},
-			},
-		},
-		Location: group.Location,
-	})
+	dds, err := parseDataDisks(*dataDisks)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	userTags, err := parseTags(*tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if *sourceVM == "" && osDisk.OsType == "" {
+		return nil, fmt.Errorf("--os-type is required")
+	}
+	if *file != "" && !imagecreate.IsBlobURL(*source) {
+		return nil, fmt.Errorf("--file requires --source to be a blob URL")
+	}
+
+	opts := &imagecreate.Options{
+		ResourceGroup:         *resourceGroup,
+		Name:                  *name,
+		Source:                *source,
+		File:                  *file,
+		Format:                *format,
+		Concurrency:           *concurrency,
+		Resume:                *resume,
+		DataDisks:             dds,
+		SourceVM:              *sourceVM,
+		Deallocate:            *deallocate,
+		Generalize:            *generalize,
+		OSType:                osDisk.OsType,
+		OSState:               osDisk.OsState,
+		Caching:               osDisk.Caching,
+		StorageAccountType:    osDisk.StorageAccountType,
+		Tags:                  userTags,
+		StagingStorageAccount: *stagingStorageAccount,
+		StagingContainer:      *stagingContainer,
+		Force:                 *force,
+		DryRun:                *dryRun,
+		SkipPermissionCheck:   *skipPermissionCheck,
+	}
+
+	if osDisk.DiskSizeGB != nil {
+		opts.DiskSizeGB = *osDisk.DiskSizeGB
+	}
+
+	if pflag.CommandLine.Changed("zone-resilient") {
+		opts.ZoneResilient = to.BoolPtr(*zoneResilient)
+	}
+
+	return opts, nil
+}
+
+// imageOSDisk returns the image OS disk settings given on the command line,
+// validated against the values known to the SDK.
+func imageOSDisk() (*compute.ImageOSDisk, error) {
+	var osDisk compute.ImageOSDisk
+	var err error
+
+	osDisk.OsType, err = imagecreate.ParseOperatingSystemType(*osType)
+	if err != nil {
+		return nil, err
+	}
+
+	osDisk.OsState, err = imagecreate.ParseOperatingSystemState(*osState)
+	if err != nil {
+		return nil, err
 	}
 
-	return future.WaitForCompletion(ctx, icli.Client)
+	osDisk.Caching, err = imagecreate.ParseCachingType(*caching)
+	if err != nil {
+		return nil, err
+	}
+
+	osDisk.StorageAccountType, err = imagecreate.ParseStorageAccountType(*storageAccountType)
+	if err != nil {
+		return nil, err
+	}
+
+	if *diskSizeGB < 0 {
+		return nil, fmt.Errorf("invalid disk size %d", *diskSizeGB)
+	}
+	if *diskSizeGB > 0 {
+		osDisk.DiskSizeGB = to.Int32Ptr(*diskSizeGB)
+	}
+
+	return &osDisk, nil
+}
+
+// withInterrupt returns a copy of parent which is also cancelled on SIGINT or
+// SIGTERM. The handler is released on the first signal, so that a second one
+// kills the process if cleanup hangs. Call stop to release it otherwise.
+func withInterrupt(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-c:
+			signal.Stop(c)
+			log.Print("interrupted: stopping; interrupt again to exit immediately")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(c)
+		cancel()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [create|export|copy|publish|apply|list|show|delete|prune|logout] [flags]\n", os.Args[0])
+	pflag.PrintDefaults()
 }
 
 func main() {
+	pflag.Usage = usage
 	pflag.Parse()
 
-	if err := run(); err != nil {
+	var err error
+	switch pflag.Arg(0) {
+	case "", "create":
+		err = run()
+	case "export":
+		err = export()
+	case "copy":
+		err = copyImage()
+	case "publish":
+		err = publish()
+	case "apply":
+		err = apply()
+	case "list":
+		err = list()
+	case "show":
+		err = show()
+	case "delete":
+		err = deleteCommand()
+	case "prune":
+		err = prune()
+	case "logout":
+		err = logout()
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
 		panic(err)
 	}
 }
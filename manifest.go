@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// manifest is a declarative description of one or more images, read from a
+// YAML or JSON file. For example:
+//
+//	images:
+//	- name: myimage
+//	  resourceGroup: images
+//	  osDisk:
+//	    osType: Linux
+//	    source: https://account.blob.core.windows.net/vhds/myimage.vhd
+//	    storageAccountType: Premium_LRS
+//	  dataDisks:
+//	  - lun: 0
+//	    source: mysnapshot
+//	  tags:
+//	    owner: me
+//	  zoneResilient: true
+type manifest struct {
+	Images []manifestImage `yaml:"images"`
+}
+
+type manifestImage struct {
+	Name          string             `yaml:"name"`
+	ResourceGroup string             `yaml:"resourceGroup"`
+	Location      string             `yaml:"location"`
+	OSDisk        manifestOSDisk     `yaml:"osDisk"`
+	DataDisks     []manifestDataDisk `yaml:"dataDisks"`
+	Tags          map[string]string  `yaml:"tags"`
+	ZoneResilient *bool              `yaml:"zoneResilient"`
+}
+
+type manifestOSDisk struct {
+	OSType             string `yaml:"osType"`
+	OSState            string `yaml:"osState"`
+	Source             string `yaml:"source"`
+	Caching            string `yaml:"caching"`
+	DiskSizeGB         int32  `yaml:"diskSizeGB"`
+	StorageAccountType string `yaml:"storageAccountType"`
+}
+
+type manifestDataDisk struct {
+	Lun                int32  `yaml:"lun"`
+	Source             string `yaml:"source"`
+	Caching            string `yaml:"caching"`
+	DiskSizeGB         int32  `yaml:"diskSizeGB"`
+	StorageAccountType string `yaml:"storageAccountType"`
+}
+
+// schema describes the permitted shape of a manifest node.
+type schema struct {
+	kind yaml.Kind
+
+	// Scalars: the required tag (e.g. "!!str"), and an optional check of the
+	// value.
+	tag   string
+	check func(string) error
+
+	// Mappings with fixed keys.
+	fields   map[string]*schema
+	required []string
+
+	// Sequence items, or the values of mappings with arbitrary keys, and an
+	// optional check of those keys.
+	values   *schema
+	checkKey func(string) error
+
+	// Sequences: whether there must be at least one item and, for sequences
+	// of mappings, a key whose value must be unique across items.
+	nonEmpty bool
+	unique   string
+}
+
+func checkNonEmpty(s string) error {
+	if s == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func checkNonNegative(s string) error {
+	i, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || i < 0 {
+		return fmt.Errorf("must be a non-negative 32-bit integer")
+	}
+	return nil
+}
+
+func checkTagKey(s string) error {
+	if imagecreate.IsProvenanceTag(s) {
+		return fmt.Errorf("tag %s is set automatically and cannot be overridden", s)
+	}
+	return nil
+}
+
+func checkEnum(parse func(string) error) func(string) error {
+	return func(s string) error {
+		if s == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		return parse(s)
+	}
+}
+
+var (
+	schemaString         = &schema{kind: yaml.ScalarNode, tag: "!!str"}
+	schemaNonEmptyString = &schema{kind: yaml.ScalarNode, tag: "!!str", check: checkNonEmpty}
+	schemaSize           = &schema{kind: yaml.ScalarNode, tag: "!!int", check: checkNonNegative}
+	schemaBool           = &schema{kind: yaml.ScalarNode, tag: "!!bool"}
+
+	schemaOSType = &schema{kind: yaml.ScalarNode, tag: "!!str", check: checkEnum(func(s string) error {
+		_, err := imagecreate.ParseOperatingSystemType(s)
+		return err
+	})}
+	schemaOSState = &schema{kind: yaml.ScalarNode, tag: "!!str", check: checkEnum(func(s string) error {
+		_, err := imagecreate.ParseOperatingSystemState(s)
+		return err
+	})}
+	schemaCaching = &schema{kind: yaml.ScalarNode, tag: "!!str", check: checkEnum(func(s string) error {
+		_, err := imagecreate.ParseCachingType(s)
+		return err
+	})}
+	schemaStorageAccountType = &schema{kind: yaml.ScalarNode, tag: "!!str", check: checkEnum(func(s string) error {
+		_, err := imagecreate.ParseStorageAccountType(s)
+		return err
+	})}
+
+	manifestSchema = &schema{
+		kind: yaml.MappingNode,
+		fields: map[string]*schema{
+			"images": {
+				kind:     yaml.SequenceNode,
+				nonEmpty: true,
+				values: &schema{
+					kind: yaml.MappingNode,
+					fields: map[string]*schema{
+						"name":          schemaNonEmptyString,
+						"resourceGroup": schemaNonEmptyString,
+						"location":      schemaNonEmptyString,
+						"osDisk": {
+							kind: yaml.MappingNode,
+							fields: map[string]*schema{
+								"osType":             schemaOSType,
+								"osState":            schemaOSState,
+								"source":             schemaNonEmptyString,
+								"caching":            schemaCaching,
+								"diskSizeGB":         schemaSize,
+								"storageAccountType": schemaStorageAccountType,
+							},
+							required: []string{"osType", "source"},
+						},
+						"dataDisks": {
+							kind: yaml.SequenceNode,
+							values: &schema{
+								kind: yaml.MappingNode,
+								fields: map[string]*schema{
+									"lun":                schemaSize,
+									"source":             schemaNonEmptyString,
+									"caching":            schemaCaching,
+									"diskSizeGB":         schemaSize,
+									"storageAccountType": schemaStorageAccountType,
+								},
+								required: []string{"lun", "source"},
+							},
+							unique: "lun",
+						},
+						"tags": {
+							kind:     yaml.MappingNode,
+							values:   schemaString,
+							checkKey: checkTagKey,
+						},
+						"zoneResilient": schemaBool,
+					},
+					required: []string{"name", "resourceGroup", "osDisk"},
+				},
+			},
+		},
+		required: []string{"images"},
+	}
+)
+
+var kindNames = map[yaml.Kind]string{
+	yaml.MappingNode:  "a mapping",
+	yaml.SequenceNode: "a sequence",
+	yaml.ScalarNode:   "a scalar",
+}
+
+var tagNames = map[string]string{
+	"!!str":  "a string",
+	"!!int":  "an integer",
+	"!!bool": "a boolean",
+}
+
+// validate checks n against s, appending any errors, prefixed with path and
+// the position of the offending node, to errs.
+func (s *schema) validate(path string, n *yaml.Node, errs *[]string) {
+	errorf := func(n *yaml.Node, format string, a ...interface{}) {
+		*errs = append(*errs, fmt.Sprintf("%s:%d:%d: ", path, n.Line, n.Column)+fmt.Sprintf(format, a...))
+	}
+
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	if n.Kind != s.kind {
+		errorf(n, "expected %s", kindNames[s.kind])
+		return
+	}
+
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.ShortTag() != s.tag {
+			errorf(n, "expected %s, found %q", tagNames[s.tag], n.Value)
+			return
+		}
+		if s.check != nil {
+			if err := s.check(n.Value); err != nil {
+				errorf(n, "%v", err)
+			}
+		}
+
+	case yaml.SequenceNode:
+		if s.nonEmpty && len(n.Content) == 0 {
+			errorf(n, "must not be empty")
+		}
+
+		seen := map[string]struct{}{}
+		for _, item := range n.Content {
+			s.values.validate(path, item, errs)
+
+			if s.unique == "" || item.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := 0; i+1 < len(item.Content); i += 2 {
+				if item.Content[i].Value != s.unique {
+					continue
+				}
+				v := item.Content[i+1]
+				if _, found := seen[v.Value]; found {
+					errorf(v, "duplicate %s %s", s.unique, v.Value)
+				}
+				seen[v.Value] = struct{}{}
+			}
+		}
+
+	case yaml.MappingNode:
+		found := map[string]struct{}{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+
+			if _, dup := found[k.Value]; dup {
+				errorf(k, "duplicate key %q", k.Value)
+				continue
+			}
+			found[k.Value] = struct{}{}
+
+			if s.values != nil {
+				if s.checkKey != nil {
+					if err := s.checkKey(k.Value); err != nil {
+						errorf(k, "%v", err)
+					}
+				}
+				s.values.validate(path, v, errs)
+				continue
+			}
+
+			f, ok := s.fields[k.Value]
+			if !ok {
+				errorf(k, "unknown key %q", k.Value)
+				continue
+			}
+			f.validate(path, v, errs)
+		}
+
+		for _, r := range s.required {
+			if _, ok := found[r]; !ok {
+				errorf(n, "missing required key %q", r)
+			}
+		}
+	}
+}
+
+// loadManifest reads, validates and decodes the manifest at path. As JSON is
+// a subset of YAML, both are accepted.
+func loadManifest(path string) (*manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty manifest", path)
+	}
+
+	var errs []string
+	manifestSchema.validate(path, doc.Content[0], &errs)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid manifest:\n%s", strings.Join(errs, "\n"))
+	}
+
+	var m manifest
+	err = doc.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &m, nil
+}
+
+// options returns the image creation options described by mi. Staging,
+// `--force` and `--dry-run` are taken from the command line.
+func (mi *manifestImage) options() (*imagecreate.Options, error) {
+	opts := &imagecreate.Options{
+		ResourceGroup:         mi.ResourceGroup,
+		Name:                  mi.Name,
+		Location:              mi.Location,
+		Source:                mi.OSDisk.Source,
+		DiskSizeGB:            mi.OSDisk.DiskSizeGB,
+		ZoneResilient:         mi.ZoneResilient,
+		StagingStorageAccount: *stagingStorageAccount,
+		StagingContainer:      *stagingContainer,
+		Force:                 *force,
+		DryRun:                *dryRun,
+	}
+	var err error
+
+	opts.OSType, err = imagecreate.ParseOperatingSystemType(mi.OSDisk.OSType)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.OSState, err = imagecreate.ParseOperatingSystemState(mi.OSDisk.OSState)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Caching, err = imagecreate.ParseCachingType(mi.OSDisk.Caching)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.StorageAccountType, err = imagecreate.ParseStorageAccountType(mi.OSDisk.StorageAccountType)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, md := range mi.DataDisks {
+		d := imagecreate.DataDisk{
+			Lun:        md.Lun,
+			Source:     md.Source,
+			DiskSizeGB: md.DiskSizeGB,
+		}
+
+		d.Caching, err = imagecreate.ParseCachingType(md.Caching)
+		if err != nil {
+			return nil, err
+		}
+
+		d.StorageAccountType, err = imagecreate.ParseStorageAccountType(md.StorageAccountType)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.DataDisks = append(opts.DataDisks, d)
+	}
+
+	if len(mi.Tags) > 0 {
+		opts.Tags = map[string]*string{}
+		for k, v := range mi.Tags {
+			opts.Tags[k] = to.StringPtr(v)
+		}
+	}
+
+	return opts, nil
+}
+
+// apply creates or updates each of the images described by the manifest at
+// `--manifest`, in order.
+func apply() error {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
+	if *manifestFile == "" {
+		return fmt.Errorf("--manifest is required")
+	}
+
+	m, err := loadManifest(*manifestFile)
+	if err != nil {
+		return err
+	}
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mi := range m.Images {
+		opts, err := mi.options()
+		if err != nil {
+			return fmt.Errorf("image %s: %v", mi.Name, err)
+		}
+		opts.SkipPermissionCheck = *skipPermissionCheck
+
+		_, err = imagecreate.New(env, subscriptionID, authorizer, *opts).Create(ctx)
+		if err != nil {
+			return fmt.Errorf("image %s: %v", mi.Name, err)
+		}
+	}
+
+	return nil
+}
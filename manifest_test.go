@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const valid = `images:
+- name: myimage
+  resourceGroup: images
+  osDisk:
+    osType: linux
+    source: https://account.blob.core.windows.net/vhds/myimage.vhd
+    storageAccountType: Premium_LRS
+  dataDisks:
+  - lun: 0
+    source: mysnapshot
+  - lun: 1
+    source: mydisk
+  tags:
+    owner: me
+  zoneResilient: true
+`
+
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		// wantErrs are the expected errors, without the path prefix.
+		wantErrs []string
+	}{
+		{
+			name:     "valid",
+			manifest: valid,
+		},
+		{
+			name:     "valid JSON",
+			manifest: `{"images": [{"name": "myimage", "resourceGroup": "images", "osDisk": {"osType": "Windows", "source": "mydisk"}}]}`,
+		},
+		{
+			name:     "empty",
+			manifest: "",
+			wantErrs: []string{"empty manifest"},
+		},
+		{
+			name:     "no images",
+			manifest: "images: []\n",
+			wantErrs: []string{"1:9: must not be empty"},
+		},
+		{
+			name:     "missing images",
+			manifest: "{}\n",
+			wantErrs: []string{`1:1: missing required key "images"`},
+		},
+		{
+			name:     "unknown keys",
+			manifest: strings.Replace(strings.Replace(valid, "  zoneResilient", "  zoneRedundant", 1), "    osType", "    ostype", 1),
+			wantErrs: []string{
+				`5:5: unknown key "ostype"`,
+				`5:5: missing required key "osType"`,
+				`15:3: unknown key "zoneRedundant"`,
+			},
+		},
+		{
+			name:     "bad enums",
+			manifest: strings.Replace(strings.Replace(valid, "linux", "plan9", 1), "Premium_LRS", "Fast_LRS", 1),
+			wantErrs: []string{
+				`5:13: invalid os type "plan9": must be one of Linux, Windows`,
+				`7:25: invalid storage account type "Fast_LRS": must be one of Premium_LRS, Standard_LRS`,
+			},
+		},
+		{
+			name:     "duplicate LUNs",
+			manifest: strings.Replace(valid, "lun: 1", "lun: 0", 1),
+			wantErrs: []string{"11:10: duplicate lun 0"},
+		},
+		{
+			name:     "non-string tag",
+			manifest: strings.Replace(valid, "owner: me", "owner: 1", 1),
+			wantErrs: []string{`14:12: expected a string, found "1"`},
+		},
+		{
+			name:     "provenance tag",
+			manifest: strings.Replace(valid, "owner: me", "sourceMD5: me", 1),
+			wantErrs: []string{"14:5: tag sourceMD5 is set automatically and cannot be overridden"},
+		},
+		{
+			name:     "wrong kind",
+			manifest: strings.Replace(valid, "zoneResilient: true", "zoneResilient: [true]", 1),
+			wantErrs: []string{"15:18: expected a scalar"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".yaml")
+			err := ioutil.WriteFile(path, []byte(tt.manifest), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadManifest(path)
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			for _, want := range tt.wantErrs {
+				if want != "empty manifest" {
+					want = path + ":" + want
+				}
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "manifest.yaml")
+	err = ioutil.WriteFile(path, []byte(`images:
+- name: myimage
+  resourceGroup: images
+  osDisk:
+    osType: linux
+    source: mydisk
+    caching: readonly
+  dataDisks:
+  - lun: 2
+    source: mysnapshot
+    storageAccountType: premium_lrs
+  tags:
+    owner: me
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := m.Images[0].options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.OSType != "Linux" || opts.Caching != "ReadOnly" {
+		t.Errorf("got OS type %q and caching %q", opts.OSType, opts.Caching)
+	}
+	if len(opts.DataDisks) != 1 || opts.DataDisks[0].Lun != 2 || opts.DataDisks[0].StorageAccountType != "Premium_LRS" {
+		t.Errorf("got data disks %+v", opts.DataDisks)
+	}
+	if len(opts.Tags) != 1 || *opts.Tags["owner"] != "me" {
+		t.Errorf("got tags %v", opts.Tags)
+	}
+}
@@ -0,0 +1,132 @@
+package imagecreate
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// copyPollInterval is the time between checks on a server-side blob copy.
+const copyPollInterval = 5 * time.Second
+
+// CopyBlob performs a server-side copy of the blob at sourceURL, which must be
+// readable by the storage service (e.g. via a SAS token), to b, logging
+// progress until the copy completes. If ctx is cancelled first, the copy is
+// aborted.
+func CopyBlob(ctx context.Context, b *storage.Blob, sourceURL string) error {
+	copyID, err := b.StartCopy(sourceURL, nil)
+	if err != nil {
+		return err
+	}
+
+	p := NewProgress("copying to "+b.Name, 0)
+
+	for {
+		err = b.GetProperties(nil)
+		if err != nil {
+			return err
+		}
+
+		if b.Properties.CopyID != copyID {
+			return fmt.Errorf("copy to %s was superseded by copy %s", b.Name, b.Properties.CopyID)
+		}
+
+		p.set(parseCopyProgress(b.Properties.CopyProgress))
+
+		switch b.Properties.CopyStatus {
+		case "success":
+			p.Finish()
+			return nil
+		case "pending":
+			select {
+			case <-time.After(copyPollInterval):
+			case <-ctx.Done():
+				log.Printf("aborting copy to %s", b.Name)
+				aerr := b.AbortCopy(copyID, nil)
+				if aerr != nil {
+					log.Printf("aborting copy to %s: %v", b.Name, aerr)
+				}
+				return ctx.Err()
+			}
+		default:
+			return fmt.Errorf("copy to %s %s: %s", b.Name, b.Properties.CopyStatus, b.Properties.CopyStatusDescription)
+		}
+	}
+}
+
+// stageBlob copies the blob at sourceURL, which may be in any storage account
+// readable by the storage service (e.g. via a SAS token), into
+// StagingContainer in StagingStorageAccount, returning the URL of the copy. If
+// no staging account is set, or the blob is already in it, sourceURL is
+// returned unchanged. With DryRun, the URL of the copy is returned without
+// copying.
+func (c *ImageCreator) stageBlob(ctx context.Context, sourceURL string) (string, error) {
+	if c.StagingStorageAccount == "" {
+		return sourceURL, nil
+	}
+
+	if u, err := parseBlobURL(sourceURL); err == nil && u.account == c.StagingStorageAccount {
+		return sourceURL, nil
+	}
+
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", err
+	}
+
+	stagedURL := BlobURL(c.Environment, c.StagingStorageAccount, c.StagingContainer, stagedBlobName(u))
+
+	if c.DryRun {
+		log.Printf("would stage %s to %s", u.Host+u.Path, stagedURL)
+		return stagedURL, nil
+	}
+
+	b, err := c.Blob(ctx, stagedURL)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = b.Container.CreateIfNotExists(&storage.CreateContainerOptions{Access: storage.ContainerAccessTypePrivate})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("staging %s to %s", u.Host+u.Path, stagedURL)
+	err = CopyBlob(ctx, b, sourceURL)
+	if err != nil {
+		return "", err
+	}
+
+	return stagedURL, nil
+}
+
+// stagedBlobName returns the name of the staged copy of the blob at u: its
+// base name prefixed with a hash of its host and path, so that blobs with the
+// same base name in different containers or accounts do not collide. Any
+// query string (e.g. a SAS token) does not affect the name.
+func stagedBlobName(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.Host + u.Path))
+	return fmt.Sprintf("%x-%s", sum[:8], path.Base(u.Path))
+}
+
+// parseCopyProgress parses the x-ms-copy-progress header, which has the form
+// "bytes copied/bytes total".
+func parseCopyProgress(s string) (done, total int64) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+
+	done, _ = strconv.ParseInt(parts[0], 10, 64)
+	total, _ = strconv.ParseInt(parts[1], 10, 64)
+
+	return done, total
+}
@@ -0,0 +1,35 @@
+package imagecreate
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStagedBlobName(t *testing.T) {
+	name := func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stagedBlobName(u)
+	}
+
+	a := name("https://one.blob.core.windows.net/vhds/disk.vhd")
+	if !strings.HasSuffix(a, "-disk.vhd") {
+		t.Errorf("%s: expected base name suffix", a)
+	}
+
+	if b := name("https://one.blob.core.windows.net/vhds/disk.vhd?sig=x"); b != a {
+		t.Errorf("got %s with SAS token, expected %s", b, a)
+	}
+
+	for _, s := range []string{
+		"https://one.blob.core.windows.net/other/disk.vhd",
+		"https://two.blob.core.windows.net/vhds/disk.vhd",
+	} {
+		if b := name(s); b == a {
+			t.Errorf("%s: staged name %s collides", s, b)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package imagecreate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Disk image formats accepted by Options.Format.
+const (
+	FormatAuto  = "auto"
+	FormatVHD   = "vhd"
+	FormatRaw   = "raw"
+	FormatQcow2 = "qcow2"
+)
+
+// openDisk returns a reader presenting the disk image in f as a fixed VHD,
+// along with the size of the VHD. Raw and qcow2 images are converted on the
+// fly; VHDs are passed through unchanged.
+func openDisk(f *os.File, format string) (io.ReaderAt, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if format == FormatAuto {
+		format, err = detectFormat(f, fi.Size())
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	switch format {
+	case FormatVHD:
+		return f, fi.Size(), nil
+
+	case FormatRaw:
+		v := newFixedVHD(f, fi.Size(), fi.ModTime())
+		return v, v.Size(), nil
+
+	case FormatQcow2:
+		q, err := newQcow2(f, fi.Size())
+		if err != nil {
+			return nil, 0, err
+		}
+
+		v := newFixedVHD(q, q.Size(), fi.ModTime())
+		return v, v.Size(), nil
+	}
+
+	return nil, 0, fmt.Errorf("invalid format %q", format)
+}
+
+// detectFormat guesses the format of a disk image from its qcow2 magic or VHD
+// footer cookie, falling back to raw.
+func detectFormat(r io.ReaderAt, size int64) (string, error) {
+	buf := make([]byte, len(qcow2Magic))
+	_, err := r.ReadAt(buf, 0)
+	if err == nil && bytes.Equal(buf, qcow2Magic) {
+		return FormatQcow2, nil
+	}
+
+	if size >= vhdFooterSize {
+		buf = make([]byte, len(vhdCookie))
+		_, err = r.ReadAt(buf, size-vhdFooterSize)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Equal(buf, vhdCookie[:]) {
+			return FormatVHD, nil
+		}
+	}
+
+	return FormatRaw, nil
+}
+
+// contextReader reads from r until ctx is cancelled, so that a pass over a
+// large disk image can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,68 @@
+package imagecreate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+)
+
+// ParseOperatingSystemType parses an OS type case-insensitively, returning the
+// SDK's spelling. An empty s is returned unchanged, leaving the field unset.
+func ParseOperatingSystemType(s string) (compute.OperatingSystemTypes, error) {
+	var possible []string
+	for _, v := range compute.PossibleOperatingSystemTypesValues() {
+		if strings.EqualFold(s, string(v)) {
+			return v, nil
+		}
+		possible = append(possible, string(v))
+	}
+	return "", invalidEnum("os type", s, possible)
+}
+
+// ParseOperatingSystemState parses an OS state (Generalized or Specialized)
+// like ParseOperatingSystemType.
+func ParseOperatingSystemState(s string) (compute.OperatingSystemStateTypes, error) {
+	var possible []string
+	for _, v := range compute.PossibleOperatingSystemStateTypesValues() {
+		if strings.EqualFold(s, string(v)) {
+			return v, nil
+		}
+		possible = append(possible, string(v))
+	}
+	return "", invalidEnum("os state", s, possible)
+}
+
+// ParseCachingType parses a disk caching type like ParseOperatingSystemType.
+func ParseCachingType(s string) (compute.CachingTypes, error) {
+	var possible []string
+	for _, v := range compute.PossibleCachingTypesValues() {
+		if strings.EqualFold(s, string(v)) {
+			return v, nil
+		}
+		possible = append(possible, string(v))
+	}
+	return "", invalidEnum("caching type", s, possible)
+}
+
+// ParseStorageAccountType parses a managed disk storage account type like
+// ParseOperatingSystemType.
+func ParseStorageAccountType(s string) (compute.StorageAccountTypes, error) {
+	var possible []string
+	for _, v := range compute.PossibleStorageAccountTypesValues() {
+		if strings.EqualFold(s, string(v)) {
+			return v, nil
+		}
+		possible = append(possible, string(v))
+	}
+	return "", invalidEnum("storage account type", s, possible)
+}
+
+// invalidEnum returns nil if s is empty, otherwise an error listing the
+// possible values.
+func invalidEnum(what, s string, possible []string) error {
+	if s == "" {
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q: must be one of %s", what, s, strings.Join(possible, ", "))
+}
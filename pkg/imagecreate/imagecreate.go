@@ -0,0 +1,484 @@
+// Package imagecreate creates Azure managed images from VHD blobs, local disk
+// images, managed disks, snapshots and generalized virtual machines.
+package imagecreate
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	mgmtstorage "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2018-02-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// Options describe the image to create.
+type Options struct {
+	ResourceGroup string
+	Name          string
+
+	// Location defaults to that of ResourceGroup.
+	Location string
+
+	// Source is the OS disk: a blob URL, or the name (in ResourceGroup) or
+	// resource ID of a managed disk or snapshot.
+	Source string
+
+	// File, if set, is a local disk image which is uploaded to the page blob
+	// at Source before the image is created. Format is one of the Format
+	// constants. Concurrency is the number of 4MiB page ranges uploaded in
+	// parallel, at most 64. If Resume is set, pages already present in the
+	// blob are not resent.
+	File        string
+	Format      string
+	Concurrency int
+	Resume      bool
+
+	DataDisks []DataDisk
+
+	// SourceVM, if set, is the name or resource ID of a virtual machine to
+	// capture instead of Source. Deallocate and Generalize bring it into the
+	// required state first.
+	SourceVM   string
+	Deallocate bool
+	Generalize bool
+
+	OSType             compute.OperatingSystemTypes
+	OSState            compute.OperatingSystemStateTypes
+	Caching            compute.CachingTypes
+	DiskSizeGB         int32
+	StorageAccountType compute.StorageAccountTypes
+	ZoneResilient      *bool
+
+	// Tags are set on the image in addition to provenance tags, which they
+	// may not override.
+	Tags map[string]*string
+
+	// StagingStorageAccount, if set, is a storage account into whose
+	// StagingContainer blob sources are first copied server-side.
+	StagingStorageAccount string
+	StagingContainer      string
+
+	// Force allows an existing image whose disk sources differ to be
+	// replaced.
+	Force bool
+
+	// DryRun validates the options and writes the request which would create
+	// or update the image to Out, without making any changes.
+	DryRun bool
+
+	// SkipPermissionCheck skips checking that the caller has the permissions
+	// needed before starting; see CheckPermissions.
+	SkipPermissionCheck bool
+}
+
+// DataDisk describes an image data disk. Source is as for Options.Source.
+type DataDisk struct {
+	Lun                int32
+	Source             string
+	Caching            compute.CachingTypes
+	DiskSizeGB         int32
+	StorageAccountType compute.StorageAccountTypes
+}
+
+// ImageCreator creates images. Its clients may be replaced before calling
+// Create, e.g. to change their base URI or retry behaviour.
+type ImageCreator struct {
+	Options
+
+	Environment    *azure.Environment
+	SubscriptionID string
+	Authorizer     autorest.Authorizer
+
+	Groups          resources.GroupsClient
+	Images          compute.ImagesClient
+	Disks           compute.DisksClient
+	Snapshots       compute.SnapshotsClient
+	VirtualMachines compute.VirtualMachinesClient
+	Accounts        mgmtstorage.AccountsClient
+	Permissions     authorization.PermissionsClient
+
+	// Blob returns a reference to the blob at a URL. The default
+	// authenticates with the storage account key, found using Accounts.
+	Blob func(ctx context.Context, blobURL string) (*storage.Blob, error)
+
+	// Out receives the request printed when DryRun is set.
+	Out io.Writer
+}
+
+// New returns an ImageCreator for the given options, with clients for the
+// cloud env using authorizer.
+func New(env *azure.Environment, subscriptionID string, authorizer autorest.Authorizer, opts Options) *ImageCreator {
+	c := &ImageCreator{
+		Options:         opts,
+		Environment:     env,
+		SubscriptionID:  subscriptionID,
+		Authorizer:      authorizer,
+		Groups:          resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Images:          compute.NewImagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Disks:           compute.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Snapshots:       compute.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		VirtualMachines: compute.NewVirtualMachinesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Accounts:        mgmtstorage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Permissions:     authorization.NewPermissionsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID),
+		Out:             os.Stdout,
+	}
+
+	c.Groups.Authorizer = authorizer
+	c.Images.Authorizer = authorizer
+	c.Disks.Authorizer = authorizer
+	c.Snapshots.Authorizer = authorizer
+	c.VirtualMachines.Authorizer = authorizer
+	c.Accounts.Authorizer = authorizer
+	c.Permissions.Authorizer = authorizer
+
+	c.Blob = func(ctx context.Context, blobURL string) (*storage.Blob, error) {
+		return getBlob(ctx, c.Accounts, blobURL)
+	}
+
+	if c.Format == "" {
+		c.Format = FormatAuto
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 8
+	}
+	if c.StagingContainer == "" {
+		c.StagingContainer = "staging"
+	}
+
+	return c
+}
+
+// Create does the same as `az image create` but additionally allows the
+// storage account type of the underlying disks to be set. The caller's
+// permissions are checked first, unless SkipPermissionCheck is set. If File is
+// set, the local disk image is then uploaded to the page blob at Source,
+// unless an existing image was already created from the same contents there.
+// Blob sources are staged if StagingStorageAccount is set, and their VHD
+// footers checked.
+// An existing image is left alone if it matches, and otherwise updated or,
+// with Force, replaced; see reconcile. Without Force, an image with a
+// different blob source is refused before anything is uploaded or staged. The
+// resulting image is returned; with DryRun, this is the image which would have
+// been sent.
+func (c *ImageCreator) Create(ctx context.Context) (*compute.Image, error) {
+	if c.DiskSizeGB < 0 {
+		return nil, fmt.Errorf("invalid disk size %d", c.DiskSizeGB)
+	}
+
+	err := checkTags(c.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.SkipPermissionCheck {
+		err := checkPermissions(ctx, c.Permissions, c.Accounts, c.requirements())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	location := c.Location
+	if location == "" {
+		group, err := c.Groups.Get(ctx, c.ResourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		location = *group.Location
+	}
+
+	existing, err := c.getImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		err = c.checkSource(existing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	image := &compute.Image{
+		ImageProperties: &compute.ImageProperties{},
+		Location:        &location,
+	}
+
+	if c.SourceVM != "" {
+		if c.Source != "" || c.File != "" || len(c.DataDisks) > 0 {
+			return nil, fmt.Errorf("a source virtual machine cannot be combined with a source, file or data disks")
+		}
+
+		var vm *compute.VirtualMachine
+		vm, err = prepareSourceVM(ctx, c.VirtualMachines, c.ResourceGroup, c.SourceVM, c.Deallocate, c.Generalize, c.DryRun)
+		if err != nil {
+			return nil, err
+		}
+
+		image.SourceVirtualMachine = &compute.SubResource{ID: vm.ID}
+		if c.StorageAccountType != "" {
+			image.StorageProfile, err = vmStorageProfile(vm, c.StorageAccountType)
+		}
+		image.Tags = ProvenanceTags(*vm.ID, "", "")
+	} else {
+		var src *diskSource
+		image.StorageProfile, src, err = c.sourceStorageProfile(ctx, existing)
+		if err == nil {
+			image.Tags = ProvenanceTags(c.Source, src.etag, src.contentMD5)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.Tags {
+		image.Tags[k] = v
+	}
+
+	if c.ZoneResilient != nil {
+		if image.StorageProfile == nil {
+			image.StorageProfile = &compute.ImageStorageProfile{}
+		}
+		image.StorageProfile.ZoneResilient = c.ZoneResilient
+	}
+
+	return c.reconcile(ctx, existing, image)
+}
+
+// sourceStorageProfile returns an image storage profile whose OS disk is
+// Source, uploading File to it first if set, and with the configured data
+// disks. The resolved OS disk source is also returned. existing is the current
+// image, if any.
+func (c *ImageCreator) sourceStorageProfile(ctx context.Context, existing *compute.Image) (*compute.ImageStorageProfile, *diskSource, error) {
+	if c.OSType == "" {
+		return nil, nil, fmt.Errorf("an OS type is required")
+	}
+
+	var src *diskSource
+	var err error
+
+	if c.File != "" {
+		if !IsBlobURL(c.Source) {
+			return nil, nil, fmt.Errorf("uploading a file requires the source to be a blob URL")
+		}
+		src = &diskSource{blobURI: to.StringPtr(c.Source)}
+		err = c.upload(ctx, src, existing)
+	} else {
+		src, err = c.resolveImageSource(ctx, c.Source, MaxOSDiskSize)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	osDisk := &compute.ImageOSDisk{
+		OsType:             c.OSType,
+		OsState:            c.OSState,
+		BlobURI:            src.blobURI,
+		ManagedDisk:        src.managedDisk,
+		Snapshot:           src.snapshot,
+		Caching:            c.Caching,
+		StorageAccountType: c.StorageAccountType,
+	}
+	if c.DiskSizeGB > 0 {
+		osDisk.DiskSizeGB = to.Int32Ptr(c.DiskSizeGB)
+	}
+
+	sp := &compute.ImageStorageProfile{
+		OsDisk: osDisk,
+	}
+
+	if len(c.DataDisks) > 0 {
+		sp.DataDisks, err = c.imageDataDisks(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return sp, src, nil
+}
+
+// imageDataDisks resolves the sources of the configured data disks, staging
+// any blob sources and checking that they are valid VHDs.
+func (c *ImageCreator) imageDataDisks(ctx context.Context) (*[]compute.ImageDataDisk, error) {
+	luns := map[int32]struct{}{}
+	disks := make([]compute.ImageDataDisk, 0, len(c.DataDisks))
+
+	for _, d := range c.DataDisks {
+		if d.Lun < 0 {
+			return nil, fmt.Errorf("invalid data disk lun %d", d.Lun)
+		}
+		if _, found := luns[d.Lun]; found {
+			return nil, fmt.Errorf("duplicate data disk lun %d", d.Lun)
+		}
+		luns[d.Lun] = struct{}{}
+
+		src, err := c.resolveImageSource(ctx, d.Source, MaxDataDiskSize)
+		if err != nil {
+			return nil, err
+		}
+
+		disk := compute.ImageDataDisk{
+			Lun:                to.Int32Ptr(d.Lun),
+			BlobURI:            src.blobURI,
+			ManagedDisk:        src.managedDisk,
+			Snapshot:           src.snapshot,
+			Caching:            d.Caching,
+			StorageAccountType: d.StorageAccountType,
+		}
+		if d.DiskSizeGB > 0 {
+			disk.DiskSizeGB = to.Int32Ptr(d.DiskSizeGB)
+		}
+
+		disks = append(disks, disk)
+	}
+
+	return &disks, nil
+}
+
+// upload uploads the local disk image File to the page blob at Source,
+// converting it to a fixed VHD if necessary, and records the ETag of the
+// uploaded blob and the MD5 of the VHD in src. If existing, the current image,
+// was created from Source, File is hashed first: if its contents are the same
+// and the blob is unchanged since, the upload is skipped, and if they differ,
+// Force is required. Otherwise the MD5 is computed while uploading.
+func (c *ImageCreator) upload(ctx context.Context, src *diskSource, existing *compute.Image) error {
+	b, err := c.Blob(ctx, c.Source)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(c.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, size, err := openDisk(f, c.Format)
+	if err != nil {
+		return err
+	}
+
+	err = validateVHD(r, size, MaxOSDiskSize)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.File, err)
+	}
+
+	if existing != nil && strings.EqualFold(str(existing.Tags[TagSource]), provenanceSource(c.Source)) {
+		current, err := c.currentBlob(ctx, b, r, size, existing)
+		if err != nil {
+			return err
+		}
+		if current {
+			src.etag, src.contentMD5 = b.Properties.Etag, str(existing.Tags[TagSourceMD5])
+			return nil
+		}
+	}
+
+	if c.DryRun {
+		log.Printf("would upload %s (%d bytes) to %s", c.File, size, c.Source)
+		return nil
+	}
+
+	sent, contentMD5, err := uploadPageBlob(ctx, b, r, size, c.Concurrency, c.Resume)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("uploaded %s: sent %d of %d bytes (%.1f%%)", c.File, sent, size, 100*float64(sent)/float64(size))
+
+	err = b.GetProperties(nil)
+	if err != nil {
+		return err
+	}
+	src.etag, src.contentMD5 = b.Properties.Etag, contentMD5
+
+	return nil
+}
+
+// currentBlob compares the MD5 of the size bytes of r with that recorded on
+// existing, which was created from the blob b. It returns true if they are the
+// same and b is unchanged since, so that nothing need be uploaded. If the contents
+// are the same but b has changed, b is uploaded again without needing Force,
+// as the image remains current. If they differ or are unknown, Force is
+// required.
+func (c *ImageCreator) currentBlob(ctx context.Context, b *storage.Blob, r io.ReaderAt, size int64, existing *compute.Image) (bool, error) {
+	existingMD5 := str(existing.Tags[TagSourceMD5])
+	if existingMD5 == "" {
+		if !c.Force {
+			return false, fmt.Errorf("image %s was created from %s with unrecorded contents: rerun with --force to replace it", c.Name, c.Source)
+		}
+		return false, nil
+	}
+
+	h := md5.New()
+	_, err := io.Copy(h, &contextReader{ctx: ctx, r: io.NewSectionReader(r, 0, size)})
+	if err != nil {
+		return false, err
+	}
+
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != existingMD5 {
+		if !c.Force {
+			return false, fmt.Errorf("image %s was created from different contents of %s: rerun with --force to replace it", c.Name, c.Source)
+		}
+		return false, nil
+	}
+
+	exists, err := b.Exists()
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		err = b.GetProperties(nil)
+		if err != nil {
+			return false, err
+		}
+
+		if b.Properties.Etag == str(existing.Tags[TagSourceETag]) {
+			log.Printf("not uploading %s: image %s was created from the same contents of %s", c.File, c.Name, c.Source)
+			return true, nil
+		}
+	}
+
+	log.Printf("uploading %s again: image %s was created from the same contents, but %s has changed since", c.File, c.Name, c.Source)
+	return false, nil
+}
+
+// ValidateBlob checks that the VHD at blobURL is acceptable to Azure as an
+// image disk of at most maxSize bytes before an image is created from it, and
+// returns the blob's properties.
+func ValidateBlob(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, blobURL string, maxSize int64) (*storage.BlobProperties, error) {
+	b, err := GetBlob(ctx, env, authorizer, subscriptionID, blobURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return validateBlob(b, blobURL, maxSize)
+}
+
+func validateBlob(b *storage.Blob, blobURL string, maxSize int64) (*storage.BlobProperties, error) {
+	err := b.GetProperties(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Properties.BlobType != storage.BlobTypePage {
+		return nil, fmt.Errorf("%s: expected a %s, found a %s", blobURL, storage.BlobTypePage, b.Properties.BlobType)
+	}
+
+	err = validateVHD(&blobReaderAt{b: b}, b.Properties.ContentLength, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", blobURL, err)
+	}
+
+	return &b.Properties, nil
+}
@@ -0,0 +1,206 @@
+package imagecreate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+	mgmtstorage "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2018-02-01/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Actions checked before work is started.
+const (
+	ActionReadResourceGroup = "Microsoft.Resources/subscriptions/resourceGroups/read"
+	ActionReadImage         = "Microsoft.Compute/images/read"
+	ActionWriteImage        = "Microsoft.Compute/images/write"
+	ActionDeleteImage       = "Microsoft.Compute/images/delete"
+	ActionReadDisk          = "Microsoft.Compute/disks/read"
+	ActionWriteDisk         = "Microsoft.Compute/disks/write"
+	ActionDeleteDisk        = "Microsoft.Compute/disks/delete"
+	ActionGrantDisk         = "Microsoft.Compute/disks/beginGetAccess/action"
+	ActionRevokeDisk        = "Microsoft.Compute/disks/endGetAccess/action"
+	ActionReadSnapshot      = "Microsoft.Compute/snapshots/read"
+	ActionWriteSnapshot     = "Microsoft.Compute/snapshots/write"
+	ActionDeleteSnapshot    = "Microsoft.Compute/snapshots/delete"
+	ActionGrantSnapshot     = "Microsoft.Compute/snapshots/beginGetAccess/action"
+	ActionRevokeSnapshot    = "Microsoft.Compute/snapshots/endGetAccess/action"
+	ActionReadVM            = "Microsoft.Compute/virtualMachines/read"
+	ActionDeallocateVM      = "Microsoft.Compute/virtualMachines/deallocate/action"
+	ActionGeneralizeVM      = "Microsoft.Compute/virtualMachines/generalize/action"
+	ActionListStorageKeys   = "Microsoft.Storage/storageAccounts/listkeys/action"
+)
+
+// Requirement is a set of actions which must be permitted on a resource
+// group or, if StorageAccount is set, on that storage account, wherever it is
+// in the subscription.
+type Requirement struct {
+	ResourceGroup  string
+	StorageAccount string
+	Actions        []string
+}
+
+func (r Requirement) String() string {
+	if r.StorageAccount != "" {
+		return "storage account " + r.StorageAccount
+	}
+	return "resource group " + r.ResourceGroup
+}
+
+// CheckPermissions asks the authorization provider for the caller's
+// effective permissions at the scope of each of reqs, and returns an error
+// listing every required action which is not permitted.
+func CheckPermissions(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID string, reqs []Requirement) error {
+	pcli := authorization.NewPermissionsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	pcli.Authorizer = authorizer
+	acli := mgmtstorage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	acli.Authorizer = authorizer
+
+	return checkPermissions(ctx, pcli, acli, reqs)
+}
+
+func checkPermissions(ctx context.Context, pcli authorization.PermissionsClient, acli mgmtstorage.AccountsClient, reqs []Requirement) error {
+	subscriptionID := pcli.SubscriptionID
+
+	var missing []string
+	for _, r := range reqs {
+		var it authorization.PermissionGetResultIterator
+		var err error
+
+		if r.StorageAccount != "" {
+			var resourceGroup string
+			resourceGroup, err = findStorageAccount(ctx, acli, subscriptionID, r.StorageAccount)
+			if err != nil {
+				return err
+			}
+			it, err = pcli.ListForResourceComplete(ctx, resourceGroup, "Microsoft.Storage", "", "storageAccounts", r.StorageAccount)
+		} else {
+			it, err = pcli.ListForResourceGroupComplete(ctx, r.ResourceGroup)
+		}
+
+		var permissions []authorization.Permission
+		for ; err == nil && it.NotDone(); err = it.Next() {
+			permissions = append(permissions, it.Value())
+		}
+		if err != nil {
+			return fmt.Errorf("checking permissions on %s: %v", r, err)
+		}
+
+		for _, action := range r.Actions {
+			if !permitted(permissions, action) {
+				missing = append(missing, fmt.Sprintf("%s on %s", action, r))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions in subscription %s:\n  %s", subscriptionID, strings.Join(missing, "\n  "))
+	}
+
+	return nil
+}
+
+// permitted returns true if any of permissions allows action, i.e. has an
+// action pattern matching it and no not-action pattern matching it.
+func permitted(permissions []authorization.Permission, action string) bool {
+	for _, p := range permissions {
+		if p.Actions == nil || !matchAny(*p.Actions, action) {
+			continue
+		}
+		if p.NotActions != nil && matchAny(*p.NotActions, action) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchAny returns true if action matches any of patterns, which are case
+// insensitive and may contain * wildcards.
+func matchAny(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		rx := "(?i)^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+		if ok, _ := regexp.MatchString(rx, action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requirements returns the permissions needed to create the image described
+// by c's options. Sources outside ResourceGroup are not checked.
+func (c *ImageCreator) requirements() []Requirement {
+	rg := Requirement{
+		ResourceGroup: c.ResourceGroup,
+		Actions:       []string{ActionReadImage, ActionWriteImage},
+	}
+	if c.Location == "" {
+		rg.Actions = append(rg.Actions, ActionReadResourceGroup)
+	}
+	if c.Force {
+		rg.Actions = append(rg.Actions, ActionDeleteImage)
+	}
+
+	if c.SourceVM != "" {
+		if !strings.HasPrefix(c.SourceVM, "/") {
+			rg.Actions = append(rg.Actions, ActionReadVM)
+			if c.Deallocate || c.Generalize {
+				rg.Actions = append(rg.Actions, ActionDeallocateVM)
+			}
+			if c.Generalize {
+				rg.Actions = append(rg.Actions, ActionGeneralizeVM)
+			}
+		}
+		return []Requirement{rg}
+	}
+
+	sources := []string{c.Source}
+	for _, d := range c.DataDisks {
+		sources = append(sources, d.Source)
+	}
+
+	// Blobs are accessed with their storage account key: a file is uploaded
+	// directly to Source, and other blob sources are read from the staging
+	// account, if set, or else in place.
+	accounts := map[string]struct{}{}
+	if c.StagingStorageAccount != "" {
+		accounts[c.StagingStorageAccount] = struct{}{}
+	}
+	if c.File != "" {
+		if u, err := parseBlobURL(c.Source); err == nil {
+			accounts[u.account] = struct{}{}
+		}
+	}
+
+	var byName bool
+	for _, s := range sources {
+		switch {
+		case IsBlobURL(s):
+			if u, err := parseBlobURL(s); err == nil && c.StagingStorageAccount == "" {
+				accounts[u.account] = struct{}{}
+			}
+		case !strings.HasPrefix(s, "/"):
+			byName = true
+		}
+	}
+	if byName {
+		rg.Actions = append(rg.Actions, ActionReadDisk, ActionReadSnapshot)
+	}
+
+	names := make([]string, 0, len(accounts))
+	for account := range accounts {
+		names = append(names, account)
+	}
+	sort.Strings(names)
+
+	reqs := []Requirement{rg}
+	for _, account := range names {
+		reqs = append(reqs, Requirement{StorageAccount: account, Actions: []string{ActionListStorageKeys}})
+	}
+
+	return reqs
+}
@@ -0,0 +1,200 @@
+package imagecreate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/authorization/mgmt/2015-07-01/authorization"
+)
+
+func TestPermitted(t *testing.T) {
+	permission := func(actions, notActions []string) authorization.Permission {
+		p := authorization.Permission{Actions: &actions}
+		if notActions != nil {
+			p.NotActions = &notActions
+		}
+		return p
+	}
+
+	for _, tt := range []struct {
+		name        string
+		permissions []authorization.Permission
+		action      string
+		want        bool
+	}{
+		{
+			name:   "no permissions",
+			action: ActionReadImage,
+		},
+		{
+			name:        "exact",
+			permissions: []authorization.Permission{permission([]string{ActionReadImage}, nil)},
+			action:      ActionReadImage,
+			want:        true,
+		},
+		{
+			name:        "other action",
+			permissions: []authorization.Permission{permission([]string{ActionReadImage}, nil)},
+			action:      ActionWriteImage,
+		},
+		{
+			name:        "case insensitive",
+			permissions: []authorization.Permission{permission([]string{"microsoft.compute/IMAGES/read"}, nil)},
+			action:      ActionReadImage,
+			want:        true,
+		},
+		{
+			name:        "star",
+			permissions: []authorization.Permission{permission([]string{"*"}, nil)},
+			action:      ActionListStorageKeys,
+			want:        true,
+		},
+		{
+			name:        "provider wildcard",
+			permissions: []authorization.Permission{permission([]string{"Microsoft.Compute/*"}, nil)},
+			action:      ActionGrantSnapshot,
+			want:        true,
+		},
+		{
+			name:        "wildcard in the middle",
+			permissions: []authorization.Permission{permission([]string{"Microsoft.Compute/*/read"}, nil)},
+			action:      ActionWriteImage,
+		},
+		{
+			name:        "wildcard is not a regexp",
+			permissions: []authorization.Permission{permission([]string{"Microsoft.Compute/images.read"}, nil)},
+			action:      "Microsoft.Compute/images/read",
+		},
+		{
+			name:        "not action",
+			permissions: []authorization.Permission{permission([]string{"*"}, []string{"Microsoft.Compute/*/delete"})},
+			action:      ActionDeleteImage,
+		},
+		{
+			name:        "not action case insensitive",
+			permissions: []authorization.Permission{permission([]string{"*"}, []string{"MICROSOFT.COMPUTE/IMAGES/DELETE"})},
+			action:      ActionDeleteImage,
+		},
+		{
+			name:        "not action other action",
+			permissions: []authorization.Permission{permission([]string{"*"}, []string{"Microsoft.Compute/*/delete"})},
+			action:      ActionWriteImage,
+			want:        true,
+		},
+		{
+			name: "not action in another permission",
+			permissions: []authorization.Permission{
+				permission([]string{"*"}, []string{ActionDeleteImage}),
+				permission([]string{ActionDeleteImage}, nil),
+			},
+			action: ActionDeleteImage,
+			want:   true,
+		},
+		{
+			name:        "nil actions",
+			permissions: []authorization.Permission{{}},
+			action:      ActionReadImage,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permitted(tt.permissions, tt.action); got != tt.want {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	const (
+		blob1 = "https://account1.blob.core.windows.net/vhds/os.vhd"
+		blob2 = "https://account2.blob.core.windows.net/vhds/data.vhd"
+		id    = "/subscriptions/s/resourceGroups/other/providers/Microsoft.Compute/disks/d"
+	)
+
+	listKeys := func(account string) Requirement {
+		return Requirement{StorageAccount: account, Actions: []string{ActionListStorageKeys}}
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts Options
+		want []Requirement
+	}{
+		{
+			name: "blob",
+			opts: Options{ResourceGroup: "rg", Location: "westus", Source: blob1},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage}},
+				listKeys("account1"),
+			},
+		},
+		{
+			name: "blob and data disk, default location, force",
+			opts: Options{ResourceGroup: "rg", Source: blob1, DataDisks: []DataDisk{{Source: blob2}}, Force: true},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage, ActionReadResourceGroup, ActionDeleteImage}},
+				listKeys("account1"),
+				listKeys("account2"),
+			},
+		},
+		{
+			name: "staged blobs",
+			opts: Options{ResourceGroup: "rg", Location: "westus", Source: blob1, DataDisks: []DataDisk{{Source: blob2}}, StagingStorageAccount: "staging"},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage}},
+				listKeys("staging"),
+			},
+		},
+		{
+			name: "file",
+			opts: Options{ResourceGroup: "rg", Location: "westus", Source: blob1, File: "disk.vhd", StagingStorageAccount: "staging"},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage}},
+				listKeys("account1"),
+				listKeys("staging"),
+			},
+		},
+		{
+			name: "disk or snapshot name",
+			opts: Options{ResourceGroup: "rg", Location: "westus", Source: "disk"},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage, ActionReadDisk, ActionReadSnapshot}},
+			},
+		},
+		{
+			name: "resource ID",
+			opts: Options{ResourceGroup: "rg", Location: "westus", Source: id},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage}},
+			},
+		},
+		{
+			name: "VM name",
+			opts: Options{ResourceGroup: "rg", Location: "westus", SourceVM: "vm"},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage, ActionReadVM}},
+			},
+		},
+		{
+			name: "VM name, generalize",
+			opts: Options{ResourceGroup: "rg", Location: "westus", SourceVM: "vm", Generalize: true},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage, ActionReadVM, ActionDeallocateVM, ActionGeneralizeVM}},
+			},
+		},
+		{
+			name: "VM resource ID",
+			opts: Options{ResourceGroup: "rg", Location: "westus", SourceVM: "/subscriptions/s/resourceGroups/other/providers/Microsoft.Compute/virtualMachines/vm", Deallocate: true},
+			want: []Requirement{
+				{ResourceGroup: "rg", Actions: []string{ActionReadImage, ActionWriteImage}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ImageCreator{Options: tt.opts}
+			if got := c.requirements(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
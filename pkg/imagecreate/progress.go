@@ -0,0 +1,66 @@
+package imagecreate
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between progress reports.
+const progressInterval = 10 * time.Second
+
+// Progress logs the progress of a long-running transfer of total bytes. It is
+// an io.Writer so that it can be used with io.TeeReader and friends.
+type Progress struct {
+	what  string
+	total int64
+
+	mu   sync.Mutex
+	done int64
+	last time.Time
+}
+
+// NewProgress returns a Progress for a transfer described by what.
+func NewProgress(what string, total int64) *Progress {
+	return &Progress{what: what, total: total, last: time.Now()}
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += int64(len(b))
+	p.report(false)
+
+	return len(b), nil
+}
+
+// set records that done of total bytes have been transferred so far.
+func (p *Progress) set(done, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done, p.total = done, total
+	p.report(false)
+}
+
+// Finish logs a final report.
+func (p *Progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.report(true)
+}
+
+func (p *Progress) report(force bool) {
+	if !force && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+
+	if p.total > 0 {
+		log.Printf("%s: %d of %d bytes (%.1f%%)", p.what, p.done, p.total, 100*float64(p.done)/float64(p.total))
+	} else {
+		log.Printf("%s: %d bytes", p.what, p.done)
+	}
+}
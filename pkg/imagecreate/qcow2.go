@@ -0,0 +1,219 @@
+package imagecreate
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// qcow2 incompatible feature bits which this reader can cope with: only the
+// dirty bit, which affects refcounts but not guest data.
+const qcow2SupportedIncompatibleFeatures = 1
+
+const (
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2Compressed     = 1 << 62
+	qcow2ZeroCluster    = 1
+	qcow2MinHeaderSize  = 72
+	qcow2MaxClusterBits = 21
+)
+
+// qcow2Header is the on-disk (big endian) qcow2 header common to versions 2
+// and 3. See docs/interop/qcow2.txt in the QEMU source tree.
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// qcow2 presents the guest-visible contents of a qcow2 image as an
+// io.ReaderAt. Backing files and encryption are not supported. It is safe for
+// concurrent use if the underlying reader is.
+type qcow2 struct {
+	r           io.ReaderAt
+	size        int64
+	clusterBits uint
+	l1          []uint64
+}
+
+// newQcow2 reads the header and L1 table of the qcow2 image of fileSize bytes
+// held in r.
+func newQcow2(r io.ReaderAt, fileSize int64) (*qcow2, error) {
+	var h qcow2Header
+	err := binary.Read(io.NewSectionReader(r, 0, qcow2MinHeaderSize), binary.BigEndian, &h)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(h.Magic[:], qcow2Magic) {
+		return nil, errors.New("not a qcow2 image")
+	}
+
+	switch h.Version {
+	case 2:
+	case 3:
+		var incompatible uint64
+		err = binary.Read(io.NewSectionReader(r, qcow2MinHeaderSize, 8), binary.BigEndian, &incompatible)
+		if err != nil {
+			return nil, err
+		}
+		if incompatible&^qcow2SupportedIncompatibleFeatures != 0 {
+			return nil, fmt.Errorf("unsupported qcow2 incompatible features %#x", incompatible)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", h.Version)
+	}
+
+	if h.BackingFileOffset != 0 {
+		return nil, errors.New("qcow2 images with backing files are not supported")
+	}
+	if h.CryptMethod != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d", h.ClusterBits)
+	}
+
+	if int64(h.Size) < 0 {
+		return nil, fmt.Errorf("invalid qcow2 image size %d", h.Size)
+	}
+
+	q := &qcow2{
+		r:           r,
+		size:        int64(h.Size),
+		clusterBits: uint(h.ClusterBits),
+	}
+
+	// Only the L1 entries covering the image size are read, however large
+	// the header claims the table is, and they must lie within the file.
+	var l1Size int64
+	if q.size > 0 {
+		l1Size = (q.size-1)/(q.clusterSize()*q.l2Entries()) + 1
+	}
+	if int64(h.L1Size) < l1Size {
+		return nil, fmt.Errorf("qcow2 L1 table too small for image size %d", q.size)
+	}
+	if h.L1TableOffset > uint64(fileSize) || l1Size*8 > fileSize-int64(h.L1TableOffset) {
+		return nil, fmt.Errorf("qcow2 L1 table at %d extends beyond end of file", h.L1TableOffset)
+	}
+
+	q.l1 = make([]uint64, l1Size)
+	err = binary.Read(io.NewSectionReader(r, int64(h.L1TableOffset), l1Size*8), binary.BigEndian, q.l1)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *qcow2) clusterSize() int64 {
+	return 1 << q.clusterBits
+}
+
+func (q *qcow2) l2Entries() int64 {
+	return q.clusterSize() / 8
+}
+
+// Size returns the virtual size of the image.
+func (q *qcow2) Size() int64 {
+	return q.size
+}
+
+func (q *qcow2) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= q.size {
+		return 0, io.EOF
+	}
+
+	for len(p) > 0 && off < q.size {
+		inCluster := off & (q.clusterSize() - 1)
+		l := q.clusterSize() - inCluster
+		if l > int64(len(p)) {
+			l = int64(len(p))
+		}
+		if l > q.size-off {
+			l = q.size - off
+		}
+
+		err = q.readCluster(p[:l], off>>q.clusterBits, inCluster)
+		if err != nil {
+			return n, err
+		}
+
+		n += int(l)
+		off += l
+		p = p[l:]
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// readCluster fills p with data from guest cluster index, starting at offset
+// inCluster within it.
+func (q *qcow2) readCluster(p []byte, index, inCluster int64) error {
+	l2Offset := q.l1[index/q.l2Entries()] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return zero(p)
+	}
+
+	var entry uint64
+	err := binary.Read(io.NewSectionReader(q.r, int64(l2Offset)+index%q.l2Entries()*8, 8), binary.BigEndian, &entry)
+	if err != nil {
+		return err
+	}
+
+	if entry&qcow2Compressed != 0 {
+		return q.readCompressedCluster(p, entry, inCluster)
+	}
+
+	offset := entry & qcow2OffsetMask
+	if offset == 0 || entry&qcow2ZeroCluster != 0 {
+		return zero(p)
+	}
+
+	_, err = q.r.ReadAt(p, int64(offset)+inCluster)
+	return err
+}
+
+// readCompressedCluster inflates the compressed cluster described by entry
+// and copies the requested part of it to p.
+func (q *qcow2) readCompressedCluster(p []byte, entry uint64, inCluster int64) error {
+	x := 62 - (q.clusterBits - 8)
+	offset := int64(entry & (1<<x - 1))
+	sectors := int64(entry>>x&(1<<(q.clusterBits-8)-1)) + 1
+	compressed := sectors*512 - offset&511
+
+	cluster := make([]byte, q.clusterSize())
+	_, err := io.ReadFull(flate.NewReader(io.NewSectionReader(q.r, offset, compressed)), cluster)
+	if err != nil {
+		return fmt.Errorf("inflating qcow2 cluster at %d: %v", offset, err)
+	}
+
+	copy(p, cluster[inCluster:])
+	return nil
+}
+
+func zero(p []byte) error {
+	for i := range p {
+		p[i] = 0
+	}
+	return nil
+}
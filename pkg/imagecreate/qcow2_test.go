@@ -0,0 +1,154 @@
+package imagecreate
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testClusterBits = 12
+	testClusterSize = 1 << testClusterBits
+	testL2Entries   = testClusterSize / 8
+	qcow2Copied     = 1 << 63
+)
+
+// testQcow2 returns a version 3 qcow2 image and the guest data it holds. The
+// first L2 table maps guest clusters 0 and 4 to data, 2 to a zero cluster and
+// 3 to a compressed cluster, leaving 1 unallocated; the second L1 entry has no
+// L2 table. File clusters are laid out as header, L1, L2, data, data, then
+// the compressed cluster at an unaligned offset.
+func testQcow2(t *testing.T) (image, guest []byte) {
+	size := int64(testL2Entries+8) * testClusterSize
+	guest = make([]byte, size)
+	for _, i := range []int64{0, 3, 4} {
+		for j := i * testClusterSize; j < (i+1)*testClusterSize; j++ {
+			guest[j] = byte(j%251 + i)
+		}
+	}
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(guest[3*testClusterSize : 4*testClusterSize])
+	w.Close()
+
+	compressedOffset := int64(5*testClusterSize + 100)
+	sectors := (compressedOffset%512 + int64(compressed.Len()) + 511) / 512
+
+	image = make([]byte, compressedOffset+sectors*512)
+
+	h := qcow2Header{
+		Version:       3,
+		ClusterBits:   testClusterBits,
+		Size:          uint64(size),
+		L1Size:        2,
+		L1TableOffset: testClusterSize,
+	}
+	copy(h.Magic[:], qcow2Magic)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	// Version 3 fields: incompatible, compatible and autoclear features,
+	// refcount order and header length.
+	binary.Write(&buf, binary.BigEndian, []uint64{0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, []uint32{4, 104})
+	copy(image, buf.Bytes())
+
+	put := func(offset int64, v uint64) {
+		binary.BigEndian.PutUint64(image[offset:], v)
+	}
+
+	put(testClusterSize, 2*testClusterSize|qcow2Copied)
+
+	l2 := int64(2 * testClusterSize)
+	put(l2, 3*testClusterSize|qcow2Copied)
+	put(l2+2*8, qcow2ZeroCluster)
+	x := uint(62 - (testClusterBits - 8))
+	put(l2+3*8, qcow2Compressed|uint64(sectors-1)<<x|uint64(compressedOffset))
+	put(l2+4*8, 4*testClusterSize|qcow2Copied)
+
+	copy(image[3*testClusterSize:], guest[:testClusterSize])
+	copy(image[4*testClusterSize:], guest[4*testClusterSize:5*testClusterSize])
+	copy(image[compressedOffset:], compressed.Bytes())
+
+	return image, guest
+}
+
+func TestQcow2(t *testing.T) {
+	image, guest := testQcow2(t)
+
+	q, err := newQcow2(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Size() != int64(len(guest)) {
+		t.Fatalf("got size %d, expected %d", q.Size(), len(guest))
+	}
+
+	b := make([]byte, len(guest))
+	n, err := q.ReadAt(b, 0)
+	if err != nil || n != len(b) {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	if !bytes.Equal(b, guest) {
+		t.Error("guest data differs")
+	}
+
+	// A read spanning the compressed and following clusters, starting
+	// part way through.
+	off := int64(3*testClusterSize + 1000)
+	b = make([]byte, 2*testClusterSize)
+	n, err = q.ReadAt(b, off)
+	if err != nil || n != len(b) {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	if !bytes.Equal(b, guest[off:off+int64(len(b))]) {
+		t.Error("guest data differs in unaligned read")
+	}
+}
+
+func TestQcow2InvalidL1(t *testing.T) {
+	image, _ := testQcow2(t)
+
+	for _, tt := range []struct {
+		name  string
+		patch func([]byte)
+	}{
+		{
+			name:  "L1 table too small",
+			patch: func(b []byte) { binary.BigEndian.PutUint32(b[36:], 1) },
+		},
+		{
+			name:  "L1 table beyond end of file",
+			patch: func(b []byte) { binary.BigEndian.PutUint64(b[40:], uint64(len(b))-8) },
+		},
+		{
+			// The 4MiB L1 table needed for a 1TiB image is larger
+			// than the file, so must not be allocated.
+			name: "huge size",
+			patch: func(b []byte) {
+				binary.BigEndian.PutUint64(b[24:], 1<<40)
+				binary.BigEndian.PutUint32(b[36:], 1<<19)
+			},
+		},
+		{
+			name:  "negative size",
+			patch: func(b []byte) { binary.BigEndian.PutUint64(b[24:], 1<<63) },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), image...)
+			tt.patch(b)
+
+			_, err := newQcow2(bytes.NewReader(b), int64(len(b)))
+			if err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package imagecreate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+)
+
+// getImage returns the image Name in ResourceGroup, or nil if it does not
+// exist.
+func (c *ImageCreator) getImage(ctx context.Context) (*compute.Image, error) {
+	image, err := c.Images.Get(ctx, c.ResourceGroup, c.Name, "")
+	switch {
+	case IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// checkSource refuses to replace an existing image created from a different
+// blob than Source unless Force is set. It is called before anything is
+// uploaded or staged; other sources are compared by reconcile once resolved.
+func (c *ImageCreator) checkSource(existing *compute.Image) error {
+	source := str(existing.Tags[TagSource])
+	if c.Force || c.SourceVM != "" || !IsBlobURL(c.Source) || !IsBlobURL(source) {
+		return nil
+	}
+
+	if !strings.EqualFold(source, provenanceSource(c.Source)) {
+		return fmt.Errorf("image %s was created from %s: rerun with --force to replace it", c.Name, source)
+	}
+
+	return nil
+}
+
+// reconcile makes existing, the image Name in ResourceGroup or nil if there is
+// none, match desired, returning the result. If the image does not exist it is
+// created. If it exists and matches, nothing is done. If only tags differ,
+// they are updated in place.
+// Otherwise the differences are logged and the image is updated, unless a
+// disk source differs: as the sources of an image cannot be changed, the image
+// is then only replaced (deleted and recreated) if Force is set. With DryRun,
+// the request that would create or update the image is written to Out instead
+// of being sent, and desired is returned.
+func (c *ImageCreator) reconcile(ctx context.Context, existing, desired *compute.Image) (*compute.Image, error) {
+	if existing == nil {
+		return c.createImage(ctx, desired)
+	}
+
+	if existing.Tags[TagCreatedAt] != nil && desired.Tags[TagCreatedAt] != nil {
+		desired.Tags[TagCreatedAt] = existing.Tags[TagCreatedAt]
+	}
+
+	diffs, replace, tagsOnly := diffImages(existing, desired)
+	if len(diffs) == 0 {
+		log.Printf("image %s is up to date", c.Name)
+		return existing, nil
+	}
+
+	log.Printf("image %s differs:\n  %s", c.Name, strings.Join(diffs, "\n  "))
+
+	if tagsOnly {
+		log.Printf("updating tags of image %s", c.Name)
+		update := compute.ImageUpdate{Tags: desired.Tags}
+		if c.DryRun {
+			return desired, c.printRequest(c.Images.UpdatePreparer(ctx, c.ResourceGroup, c.Name, update))
+		}
+
+		future, err := c.Images.Update(ctx, c.ResourceGroup, c.Name, update)
+		if err != nil {
+			return nil, err
+		}
+
+		err = future.WaitForCompletion(ctx, c.Images.Client)
+		if err != nil {
+			return nil, err
+		}
+
+		image, err := future.Result(c.Images)
+		return &image, err
+	}
+
+	if !replace {
+		log.Printf("updating image %s", c.Name)
+		return c.createOrUpdateImage(ctx, desired)
+	}
+
+	if !c.Force {
+		return nil, fmt.Errorf("image %s has different disk sources: rerun with --force to replace it", c.Name)
+	}
+
+	if c.DryRun {
+		log.Printf("would delete image %s", c.Name)
+		return c.createImage(ctx, desired)
+	}
+
+	log.Printf("deleting image %s", c.Name)
+	future, err := c.Images.Delete(ctx, c.ResourceGroup, c.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = future.WaitForCompletion(ctx, c.Images.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.createImage(ctx, desired)
+}
+
+func (c *ImageCreator) createImage(ctx context.Context, image *compute.Image) (*compute.Image, error) {
+	log.Printf("creating image %s in resource group %s", c.Name, c.ResourceGroup)
+	return c.createOrUpdateImage(ctx, image)
+}
+
+func (c *ImageCreator) createOrUpdateImage(ctx context.Context, image *compute.Image) (*compute.Image, error) {
+	if c.DryRun {
+		return image, c.printRequest(c.Images.CreateOrUpdatePreparer(ctx, c.ResourceGroup, c.Name, *image))
+	}
+
+	future, err := c.Images.CreateOrUpdate(ctx, c.ResourceGroup, c.Name, *image)
+	if err != nil {
+		return nil, err
+	}
+
+	err = future.WaitForCompletion(ctx, c.Images.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := future.Result(c.Images)
+	return &result, err
+}
+
+// printRequest writes the method, URL and JSON body of a prepared request to
+// Out, without sending it.
+func (c *ImageCreator) printRequest(req *http.Request, err error) error {
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = json.Indent(&buf, body, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.Out, "%s %s\n%s\n", req.Method, req.URL, buf.String())
+	return err
+}
+
+// diffImages returns a readable description of each way in which existing
+// differs from desired, whether any disk source differs, and whether only tags
+// differ. Settings left unset in desired are defaulted by Azure and so are not
+// compared, nor is the creation time tag. A change to the recorded ETag or MD5
+// of the source means its contents differ, as for a change of source.
+func diffImages(existing, desired *compute.Image) (diffs []string, replace, tagsOnly bool) {
+	d := &differ{}
+
+	if normalizeLocation(existing.Location) != normalizeLocation(desired.Location) {
+		d.add("location", str(existing.Location), str(desired.Location))
+	}
+
+	have, want := &compute.ImageProperties{}, &compute.ImageProperties{}
+	if existing.ImageProperties != nil {
+		have = existing.ImageProperties
+	}
+	if desired.ImageProperties != nil {
+		want = desired.ImageProperties
+	}
+
+	if want.SourceVirtualMachine != nil {
+		d.source("sourceVirtualMachine", subResourceID(have.SourceVirtualMachine), subResourceID(want.SourceVirtualMachine))
+	}
+
+	if want.StorageProfile != nil {
+		hsp := have.StorageProfile
+		if hsp == nil {
+			hsp = &compute.ImageStorageProfile{}
+		}
+		d.storageProfile(hsp, want.StorageProfile, want.SourceVirtualMachine == nil)
+	}
+
+	d.tags(existing.Tags, desired.Tags)
+
+	return d.diffs, d.replace, !d.update
+}
+
+// differ accumulates the differences found by diffImages.
+type differ struct {
+	diffs   []string
+	replace bool
+	update  bool
+}
+
+func (d *differ) add(field, have, want string) {
+	d.diffs = append(d.diffs, fmt.Sprintf("%s: %s -> %s", field, quote(have), quote(want)))
+	d.update = true
+}
+
+// source compares disk sources, which are resource IDs (case insensitive) or
+// blob URLs.
+func (d *differ) source(field, have, want string) {
+	if !strings.EqualFold(have, want) {
+		d.add(field, have, want)
+		d.replace = true
+	}
+}
+
+// setting compares a setting if it is set in desired.
+func (d *differ) setting(field, have, want string) {
+	if want != "" && !strings.EqualFold(have, want) {
+		d.add(field, have, want)
+	}
+}
+
+func (d *differ) storageProfile(have, want *compute.ImageStorageProfile, compareSources bool) {
+	if want.ZoneResilient != nil {
+		d.setting("zoneResilient", boolStr(have.ZoneResilient), boolStr(want.ZoneResilient))
+	}
+
+	if want.OsDisk != nil {
+		ho, wo := have.OsDisk, want.OsDisk
+		if ho == nil {
+			ho = &compute.ImageOSDisk{}
+		}
+
+		if compareSources {
+			d.source("osDisk.source", diskSourceID(ho.BlobURI, ho.ManagedDisk, ho.Snapshot), diskSourceID(wo.BlobURI, wo.ManagedDisk, wo.Snapshot))
+		}
+		d.setting("osDisk.osType", string(ho.OsType), string(wo.OsType))
+		d.setting("osDisk.osState", string(ho.OsState), string(wo.OsState))
+		d.setting("osDisk.caching", string(ho.Caching), string(wo.Caching))
+		d.setting("osDisk.diskSizeGB", int32Str(ho.DiskSizeGB), int32Str(wo.DiskSizeGB))
+		d.setting("osDisk.storageAccountType", string(ho.StorageAccountType), string(wo.StorageAccountType))
+	}
+
+	hdds := map[int32]compute.ImageDataDisk{}
+	if have.DataDisks != nil {
+		for _, dd := range *have.DataDisks {
+			hdds[*dd.Lun] = dd
+		}
+	}
+
+	wdds := map[int32]compute.ImageDataDisk{}
+	if want.DataDisks != nil {
+		for _, dd := range *want.DataDisks {
+			wdds[*dd.Lun] = dd
+		}
+	}
+
+	var luns []int
+	for lun := range hdds {
+		luns = append(luns, int(lun))
+	}
+	for lun := range wdds {
+		if _, found := hdds[lun]; !found {
+			luns = append(luns, int(lun))
+		}
+	}
+	sort.Ints(luns)
+
+	for _, lun := range luns {
+		field := fmt.Sprintf("dataDisks[lun=%d]", lun)
+		hd, hfound := hdds[int32(lun)]
+		wd, wfound := wdds[int32(lun)]
+
+		switch {
+		case !wfound:
+			if compareSources {
+				d.diffs = append(d.diffs, field+": removed")
+				d.replace, d.update = true, true
+			}
+			continue
+		case !hfound:
+			d.diffs = append(d.diffs, field+": added")
+			d.replace, d.update = true, true
+			continue
+		}
+
+		if compareSources {
+			d.source(field+".source", diskSourceID(hd.BlobURI, hd.ManagedDisk, hd.Snapshot), diskSourceID(wd.BlobURI, wd.ManagedDisk, wd.Snapshot))
+		}
+		d.setting(field+".caching", string(hd.Caching), string(wd.Caching))
+		d.setting(field+".diskSizeGB", int32Str(hd.DiskSizeGB), int32Str(wd.DiskSizeGB))
+		d.setting(field+".storageAccountType", string(hd.StorageAccountType), string(wd.StorageAccountType))
+	}
+}
+
+func (d *differ) tags(have, want map[string]*string) {
+	keys := map[string]struct{}{}
+	for k := range have {
+		keys[k] = struct{}{}
+	}
+	for k := range want {
+		keys[k] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	changed := contentsChanged(have, want)
+	for _, k := range sorted {
+		if k == TagCreatedAt || str(have[k]) == str(want[k]) {
+			continue
+		}
+
+		d.diffs = append(d.diffs, fmt.Sprintf("tags.%s: %s -> %s", k, quote(str(have[k])), quote(str(want[k]))))
+		if (k == TagSourceETag || k == TagSourceMD5) && changed {
+			d.replace, d.update = true, true
+		}
+	}
+}
+
+// contentsChanged returns true if the provenance tags show that the source's
+// contents have changed: their MD5s differ or, if either is unknown, their
+// ETags do. Uploading the same contents again changes only the ETag.
+func contentsChanged(have, want map[string]*string) bool {
+	if have[TagSourceMD5] != nil && want[TagSourceMD5] != nil {
+		return *have[TagSourceMD5] != *want[TagSourceMD5]
+	}
+	return have[TagSourceETag] != nil && want[TagSourceETag] != nil && *have[TagSourceETag] != *want[TagSourceETag]
+}
+
+// diskSourceID returns whichever of the given disk sources is set.
+func diskSourceID(blobURI *string, managedDisk, snapshot *compute.SubResource) string {
+	switch {
+	case blobURI != nil:
+		return *blobURI
+	case managedDisk != nil:
+		return subResourceID(managedDisk)
+	case snapshot != nil:
+		return subResourceID(snapshot)
+	}
+	return ""
+}
+
+func subResourceID(r *compute.SubResource) string {
+	if r == nil {
+		return ""
+	}
+	return str(r.ID)
+}
+
+// normalizeLocation converts a location display name (e.g. "West US") to its
+// canonical form ("westus").
+func normalizeLocation(s *string) string {
+	return strings.ToLower(strings.Replace(str(s), " ", "", -1))
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func int32Str(i *int32) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*i))
+}
+
+func boolStr(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+func quote(s string) string {
+	if s == "" {
+		return "(unset)"
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,144 @@
+package imagecreate
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func testImage(blobURI, etag string, tags map[string]*string) *compute.Image {
+	image := &compute.Image{
+		Location: to.StringPtr("westus"),
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{
+				OsDisk: &compute.ImageOSDisk{
+					OsType:  compute.Linux,
+					BlobURI: to.StringPtr(blobURI),
+				},
+			},
+		},
+		Tags: ProvenanceTags(blobURI, etag, ""),
+	}
+	for k, v := range tags {
+		image.Tags[k] = v
+	}
+
+	return image
+}
+
+func TestDiffImages(t *testing.T) {
+	const blob = "https://account.blob.core.windows.net/vhds/disk.vhd"
+
+	for _, tt := range []struct {
+		name         string
+		desired      *compute.Image
+		wantDiffs    bool
+		wantReplace  bool
+		wantTagsOnly bool
+	}{
+		{
+			name:         "same",
+			desired:      testImage(blob, `"1"`, nil),
+			wantTagsOnly: true,
+		},
+		{
+			name:         "tag",
+			desired:      testImage(blob, `"1"`, map[string]*string{"owner": to.StringPtr("me")}),
+			wantDiffs:    true,
+			wantTagsOnly: true,
+		},
+		{
+			name:        "source",
+			desired:     testImage(blob+"2", `"1"`, nil),
+			wantDiffs:   true,
+			wantReplace: true,
+		},
+		{
+			name:        "source contents",
+			desired:     testImage(blob, `"2"`, nil),
+			wantDiffs:   true,
+			wantReplace: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, replace, tagsOnly := diffImages(testImage(blob, `"1"`, nil), tt.desired)
+			if (len(diffs) > 0) != tt.wantDiffs || replace != tt.wantReplace || tagsOnly != tt.wantTagsOnly {
+				t.Errorf("got diffs %q, replace %v, tagsOnly %v", diffs, replace, tagsOnly)
+			}
+		})
+	}
+}
+
+func TestDiffImagesContentMD5(t *testing.T) {
+	const blob = "https://account.blob.core.windows.net/vhds/disk.vhd"
+	md5 := func(s string) map[string]*string {
+		return map[string]*string{TagSourceMD5: to.StringPtr(s)}
+	}
+
+	for _, tt := range []struct {
+		name         string
+		desired      *compute.Image
+		wantReplace  bool
+		wantTagsOnly bool
+	}{
+		{
+			name:         "same contents uploaded again",
+			desired:      testImage(blob, `"2"`, md5("a")),
+			wantTagsOnly: true,
+		},
+		{
+			name:        "different contents",
+			desired:     testImage(blob, `"1"`, md5("b")),
+			wantReplace: true,
+		},
+		{
+			name:        "different contents uploaded again",
+			desired:     testImage(blob, `"2"`, md5("b")),
+			wantReplace: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, replace, tagsOnly := diffImages(testImage(blob, `"1"`, md5("a")), tt.desired)
+			if len(diffs) == 0 || replace != tt.wantReplace || tagsOnly != tt.wantTagsOnly {
+				t.Errorf("got diffs %q, replace %v, tagsOnly %v", diffs, replace, tagsOnly)
+			}
+		})
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	existing := testImage("https://account.blob.core.windows.net/vhds/disk.vhd", "", nil)
+
+	for _, tt := range []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{
+			name: "same",
+			opts: Options{Source: "https://account.blob.core.windows.net/vhds/disk.vhd?sig=x"},
+		},
+		{
+			name:    "different",
+			opts:    Options{Source: "https://account.blob.core.windows.net/vhds/other.vhd"},
+			wantErr: true,
+		},
+		{
+			name: "different with force",
+			opts: Options{Source: "https://account.blob.core.windows.net/vhds/other.vhd", Force: true},
+		},
+		{
+			name: "managed disk",
+			opts: Options{Source: "disk"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ImageCreator{Options: tt.opts}
+			err := c.checkSource(existing)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package imagecreate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// diskSource identifies the contents of an image disk. Exactly one of
+// blobURI, managedDisk and snapshot is set.
+type diskSource struct {
+	blobURI     *string
+	managedDisk *compute.SubResource
+	snapshot    *compute.SubResource
+
+	// Properties of a validated blob source, for provenance tags.
+	etag       string
+	contentMD5 string
+}
+
+// IsBlobURL returns true if s looks like a URL rather than a resource ID or
+// name.
+func IsBlobURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// resolveSource interprets s as a blob URL, the resource ID of a managed disk
+// or snapshot, possibly in another subscription, or the name of a managed disk
+// or snapshot in ResourceGroup.
+func (c *ImageCreator) resolveSource(ctx context.Context, s string) (*diskSource, error) {
+	if IsBlobURL(s) {
+		return &diskSource{blobURI: &s}, nil
+	}
+
+	if strings.HasPrefix(s, "/") {
+		r, err := azure.ParseResourceID(s)
+		if err != nil {
+			return nil, err
+		}
+
+		dcli, scli := c.Disks, c.Snapshots
+		dcli.SubscriptionID, scli.SubscriptionID = r.SubscriptionID, r.SubscriptionID
+
+		switch {
+		case strings.EqualFold(r.Provider, "Microsoft.Compute") && strings.EqualFold(r.ResourceType, "disks"):
+			return getManagedDiskSource(ctx, dcli, r.ResourceGroup, r.ResourceName)
+		case strings.EqualFold(r.Provider, "Microsoft.Compute") && strings.EqualFold(r.ResourceType, "snapshots"):
+			return getSnapshotSource(ctx, scli, r.ResourceGroup, r.ResourceName)
+		}
+
+		return nil, fmt.Errorf("%s: expected a managed disk or snapshot resource ID", s)
+	}
+
+	src, err := getManagedDiskSource(ctx, c.Disks, c.ResourceGroup, s)
+	if !IsNotFound(err) {
+		return src, err
+	}
+
+	src, err = getSnapshotSource(ctx, c.Snapshots, c.ResourceGroup, s)
+	if IsNotFound(err) {
+		return nil, fmt.Errorf("no managed disk or snapshot named %s found in resource group %s", s, c.ResourceGroup)
+	}
+
+	return src, err
+}
+
+// resolveImageSource resolves s in ResourceGroup as resolveSource does. Blob
+// sources are then staged if StagingStorageAccount is set, and checked to be
+// VHDs of at most maxSize bytes.
+func (c *ImageCreator) resolveImageSource(ctx context.Context, s string, maxSize int64) (*diskSource, error) {
+	src, err := c.resolveSource(ctx, s)
+	if err != nil || src.blobURI == nil {
+		return src, err
+	}
+
+	staged, err := c.stageBlob(ctx, *src.blobURI)
+	if err != nil {
+		return nil, err
+	}
+
+	// With DryRun, the staged copy does not exist and blobs outside the
+	// subscription may not be readable, so only blobs which would be used in
+	// place are validated.
+	if !c.DryRun || staged == *src.blobURI {
+		b, err := c.Blob(ctx, staged)
+		if err != nil {
+			return nil, err
+		}
+
+		props, err := validateBlob(b, staged, maxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		// A staged copy has a new ETag each time it is made, so only the
+		// ETag of a blob used in place identifies its contents.
+		if staged == *src.blobURI {
+			src.etag = props.Etag
+		}
+		src.contentMD5 = props.ContentMD5
+	}
+
+	src.blobURI = &staged
+
+	return src, nil
+}
+
+func getManagedDiskSource(ctx context.Context, dcli compute.DisksClient, resourceGroup, name string) (*diskSource, error) {
+	disk, err := dcli.Get(ctx, resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskSource{managedDisk: &compute.SubResource{ID: disk.ID}}, nil
+}
+
+func getSnapshotSource(ctx context.Context, scli compute.SnapshotsClient, resourceGroup, name string) (*diskSource, error) {
+	snapshot, err := scli.Get(ctx, resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskSource{snapshot: &compute.SubResource{ID: snapshot.ID}}, nil
+}
+
+// IsNotFound returns true if err is an ARM 404 response.
+func IsNotFound(err error) bool {
+	derr, ok := err.(autorest.DetailedError)
+	return ok && derr.StatusCode == http.StatusNotFound
+}
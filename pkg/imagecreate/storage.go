@@ -0,0 +1,202 @@
+package imagecreate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mgmtstorage "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2018-02-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// maxConcurrency is the largest permitted Options.Concurrency.
+const maxConcurrency = 64
+
+// storageHTTPClient is used for all blob requests. Unlike http.DefaultClient,
+// it keeps an idle connection per upload worker, so that each Put Page call
+// does not pay for a new TLS connection.
+var storageHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100 + maxConcurrency,
+		MaxIdleConnsPerHost:   maxConcurrency,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// blobURL holds the components of a URL of the form
+// https://$STORAGEACCOUNT.blob.$SUFFIX/$CONTAINER/$BLOB.
+type blobURL struct {
+	account   string
+	suffix    string
+	container string
+	blob      string
+	https     bool
+}
+
+func parseBlobURL(s string) (*blobURL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	host := strings.SplitN(u.Host, ".", 3)
+	if len(host) != 3 || host[1] != "blob" {
+		return nil, fmt.Errorf("%s: not a blob URL", s)
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(path) != 2 || path[0] == "" || path[1] == "" {
+		return nil, fmt.Errorf("%s: blob URL must include container and blob name", s)
+	}
+
+	return &blobURL{
+		account:   host[0],
+		suffix:    host[2],
+		container: path[0],
+		blob:      path[1],
+		https:     u.Scheme == "https",
+	}, nil
+}
+
+// BlobURL returns the URL of the named blob in env.
+func BlobURL(env *azure.Environment, account, container, blob string) string {
+	return fmt.Sprintf("https://%s.blob.%s/%s/%s", account, env.StorageEndpointSuffix, container, blob)
+}
+
+// getStorageAccountKey looks up the named storage account in the subscription
+// and returns its primary key.
+func getStorageAccountKey(ctx context.Context, acli mgmtstorage.AccountsClient, account string) (string, error) {
+	resourceGroup, err := findStorageAccount(ctx, acli, acli.SubscriptionID, account)
+	if err != nil {
+		return "", err
+	}
+
+	keys, err := acli.ListKeys(ctx, resourceGroup, account)
+	if err != nil {
+		return "", err
+	}
+	if keys.Keys == nil || len(*keys.Keys) == 0 {
+		return "", fmt.Errorf("storage account %s has no keys", account)
+	}
+
+	return *(*keys.Keys)[0].Value, nil
+}
+
+// findStorageAccount returns the resource group of the named storage account
+// in the subscription.
+func findStorageAccount(ctx context.Context, acli mgmtstorage.AccountsClient, subscriptionID, account string) (string, error) {
+	a, err := getStorageAccount(ctx, acli, subscriptionID, account)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := azure.ParseResourceID(*a.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return r.ResourceGroup, nil
+}
+
+// getStorageAccount returns the named storage account in the subscription.
+func getStorageAccount(ctx context.Context, acli mgmtstorage.AccountsClient, subscriptionID, account string) (*mgmtstorage.Account, error) {
+	accounts, err := acli.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range *accounts.Value {
+		if a.Name != nil && *a.Name == account {
+			return &a, nil
+		}
+	}
+
+	return nil, fmt.Errorf("storage account %s not found in subscription %s", account, subscriptionID)
+}
+
+// CheckStorageAccountLocation checks that the named storage account in the
+// subscription is in location, as images can only be created from blobs in
+// their own region. It is worth calling before copying blobs into the account.
+func CheckStorageAccountLocation(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, account, location string) error {
+	acli := mgmtstorage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	acli.Authorizer = authorizer
+
+	a, err := getStorageAccount(ctx, acli, subscriptionID, account)
+	if err != nil {
+		return err
+	}
+
+	if normalizeLocation(a.Location) != normalizeLocation(&location) {
+		return fmt.Errorf("storage account %s is in %s, not %s", account, str(a.Location), location)
+	}
+
+	return nil
+}
+
+// GetBlob returns a reference to the blob at the given URL, authenticated
+// with the storage account key, which is looked up in the subscription.
+func GetBlob(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, s string) (*storage.Blob, error) {
+	acli := mgmtstorage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	acli.Authorizer = authorizer
+
+	return getBlob(ctx, acli, s)
+}
+
+func getBlob(ctx context.Context, acli mgmtstorage.AccountsClient, s string) (*storage.Blob, error) {
+	u, err := parseBlobURL(s)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := getStorageAccountKey(ctx, acli, u.account)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := storage.NewClient(u.account, key, u.suffix, storage.DefaultAPIVersion, u.https)
+	if err != nil {
+		return nil, err
+	}
+	c.HTTPClient = storageHTTPClient
+
+	bs := c.GetBlobService()
+	return bs.GetContainerReference(u.container).GetBlobReference(u.blob), nil
+}
+
+// blobReaderAt reads from a blob using ranged GETs.
+type blobReaderAt struct {
+	b *storage.Blob
+}
+
+func (r *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	rc, err := r.b.GetRange(&storage.GetBlobRangeOptions{
+		Range: &storage.BlobRange{
+			Start: uint64(off),
+			End:   uint64(off) + uint64(len(p)) - 1,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	return io.ReadFull(rc, p)
+}
@@ -0,0 +1,82 @@
+package imagecreate
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// Version is the version of this package, recorded in the TagCreatedBy tag.
+// It is set at build time with -ldflags "-X
+// github.com/jim-minter/azure-image-create/pkg/imagecreate.Version=...".
+var Version = "dev"
+
+// Provenance tags set automatically on created images.
+const (
+	TagSource     = "source"
+	TagSourceETag = "sourceETag"
+	TagSourceMD5  = "sourceMD5"
+	TagCreatedAt  = "createdAt"
+	TagCreatedBy  = "createdBy"
+)
+
+// MaxTagValueLength is the longest tag value Azure accepts.
+const MaxTagValueLength = 256
+
+// ProvenanceTags returns tags recording that an image was created now, by this
+// package, from source, with the given blob ETag and Content-MD5 if known. Any
+// query string (e.g. a SAS token) is removed from source.
+func ProvenanceTags(source, etag, contentMD5 string) map[string]*string {
+	tags := map[string]*string{
+		TagSource:    to.StringPtr(provenanceSource(source)),
+		TagCreatedAt: to.StringPtr(time.Now().UTC().Format(time.RFC3339)),
+		TagCreatedBy: to.StringPtr("azure-image-create " + Version),
+	}
+
+	if etag != "" {
+		tags[TagSourceETag] = to.StringPtr(etag)
+	}
+	if contentMD5 != "" {
+		tags[TagSourceMD5] = to.StringPtr(contentMD5)
+	}
+
+	return tags
+}
+
+// IsProvenanceTag returns true if key is one of the provenance tags. Like
+// Azure, it ignores case.
+func IsProvenanceTag(key string) bool {
+	for _, tag := range []string{TagSource, TagSourceETag, TagSourceMD5, TagCreatedAt, TagCreatedBy} {
+		if strings.EqualFold(key, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTags returns an error if tags would override a provenance tag, on
+// which replacing, skipping uploads and pruning depend.
+func checkTags(tags map[string]*string) error {
+	for k := range tags {
+		if IsProvenanceTag(k) {
+			return fmt.Errorf("tag %s is set automatically and cannot be overridden", k)
+		}
+	}
+	return nil
+}
+
+// provenanceSource returns source as recorded in the TagSource tag.
+func provenanceSource(source string) string {
+	if u, err := url.Parse(source); err == nil && u.RawQuery != "" {
+		u.RawQuery = ""
+		source = u.String()
+	}
+	if len(source) > MaxTagValueLength {
+		source = source[:MaxTagValueLength]
+	}
+
+	return source
+}
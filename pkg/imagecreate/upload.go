@@ -0,0 +1,337 @@
+package imagecreate
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// maxPageRangeSize is the largest range accepted by a single Put Page call.
+const maxPageRangeSize = 4 * 1024 * 1024
+
+// uploadAttempts is the number of times a page range is tried before the
+// upload is abandoned, if no response is received; see retry.
+const uploadAttempts = 5
+
+// retryDelay is the delay before the first retry, doubling each time.
+var retryDelay = time.Second
+
+// zeroPage is compared against to detect pages which need not be sent.
+var zeroPage = make([]byte, 512)
+
+// uploadPageBlob creates the page blob b with the given size and writes the
+// contents of r to it, uploading up to concurrency chunks of maxPageRangeSize
+// bytes in parallel. size must be a multiple of 512 bytes. A new page blob
+// reads as zeros, so pages which are entirely zero are skipped. It returns the
+// number of bytes actually sent and the base64 MD5 of the contents of r, which
+// is read once, in order.
+//
+// If resume is set and b already exists with the right size, it is not
+// recreated. Instead, the MD5 of each chunk which already has pages written is
+// fetched from the service and compared with that of the local content; only
+// chunks which are missing or mismatched are uploaded.
+//
+// The upload stops, leaving b partly written, once ctx is cancelled.
+func uploadPageBlob(ctx context.Context, b *storage.Blob, r io.ReaderAt, size int64, concurrency int, resume bool) (sent int64, contentMD5 string, err error) {
+	if size%512 != 0 {
+		return 0, "", fmt.Errorf("size %d is not a multiple of 512 bytes", size)
+	}
+	if concurrency < 1 || concurrency > maxConcurrency {
+		return 0, "", fmt.Errorf("invalid concurrency %d: must be between 1 and %d", concurrency, maxConcurrency)
+	}
+
+	var existing []storage.PageRange
+	if resume {
+		existing, resume, err = existingPageRanges(b, size)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	if !resume {
+		b.Properties.ContentLength = size
+		err = b.PutPageBlob(nil)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	type chunk struct {
+		offset int64
+		buf    []byte
+	}
+
+	// Chunks are read and hashed here and uploaded by the workers, which
+	// hand their buffers back when done. One buffer more than there are
+	// workers lets the next chunk be read while all of them are busy.
+	chunks := make(chan chunk)
+	free := make(chan []byte, concurrency+1)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, maxPageRangeSize)
+	}
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// GetRange records the response headers in the blob's
+			// properties, so each worker has its own copy.
+			b := *b
+			for c := range chunks {
+				n, err := uploadChunk(ctx, &b, c.offset, c.buf, existing)
+				atomic.AddInt64(&sent, n)
+				if err != nil {
+					errs <- err
+					return
+				}
+				free <- c.buf[:cap(c.buf)]
+			}
+		}()
+	}
+
+	h := md5.New()
+loop:
+	for offset := int64(0); offset < size; offset += maxPageRangeSize {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case err = <-errs:
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+
+		if size-offset < int64(len(buf)) {
+			buf = buf[:size-offset]
+		}
+
+		var n int
+		n, err = r.ReadAt(buf, offset)
+		if n < len(buf) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			break
+		}
+		err = nil
+		h.Write(buf)
+
+		select {
+		case chunks <- chunk{offset: offset, buf: buf}:
+		case err = <-errs:
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	if err != nil {
+		return sent, "", err
+	}
+
+	return sent, base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// existingPageRanges returns the page ranges already written to b. ok is false
+// if b does not exist as a page blob of the given size, in which case the
+// upload must start from scratch.
+func existingPageRanges(b *storage.Blob, size int64) (ranges []storage.PageRange, ok bool, err error) {
+	exists, err := b.Exists()
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	err = b.GetProperties(nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if b.Properties.BlobType != storage.BlobTypePage || b.Properties.ContentLength != size {
+		log.Printf("not resuming: %s is a %s of %d bytes, expected a %s of %d bytes", b.Name, b.Properties.BlobType, b.Properties.ContentLength, storage.BlobTypePage, size)
+		return nil, false, nil
+	}
+
+	resp, err := b.GetPageRanges(nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var present int64
+	for _, pr := range resp.PageList {
+		present += pr.End - pr.Start + 1
+	}
+	log.Printf("resuming: %d of %d bytes already present in %s", present, size, b.Name)
+
+	return resp.PageList, true, nil
+}
+
+// uploadChunk brings the chunk of b starting at offset up to date with buf.
+// existing lists the page ranges of b which may hold data; if any overlap the
+// chunk, it is only written if the MD5 of its contents, as computed by the
+// service, differs. Each page range is retried independently.
+func uploadChunk(ctx context.Context, b *storage.Blob, offset int64, buf []byte, existing []storage.PageRange) (sent int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	br := storage.BlobRange{
+		Start: uint64(offset),
+		End:   uint64(offset) + uint64(len(buf)) - 1,
+	}
+
+	writes, clears := pageRanges(buf)
+	if overlaps(existing, offset, offset+int64(len(buf))) {
+		var remoteMD5 string
+		err = retry(ctx, uploadAttempts, func() error {
+			rc, err := b.GetRange(&storage.GetBlobRangeOptions{Range: &br, GetRangeContentMD5: true})
+			if err != nil {
+				return err
+			}
+
+			// Only the Content-MD5 header is wanted: the body is
+			// abandoned unread.
+			rc.Close()
+			remoteMD5 = b.Properties.ContentMD5
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("reading %s: %v", br, err)
+		}
+
+		sum := md5.Sum(buf)
+		if remoteMD5 == base64.StdEncoding.EncodeToString(sum[:]) {
+			return 0, nil
+		}
+	} else {
+		// A new page blob reads as zeros.
+		clears = nil
+	}
+
+	for _, rng := range clears {
+		cr := storage.BlobRange{
+			Start: uint64(offset + rng.start),
+			End:   uint64(offset + rng.end - 1),
+		}
+
+		err = retry(ctx, uploadAttempts, func() error {
+			return b.ClearRange(cr, nil)
+		})
+		if err != nil {
+			return sent, fmt.Errorf("clearing %s: %v", cr, err)
+		}
+	}
+
+	for _, rng := range writes {
+		wr := storage.BlobRange{
+			Start: uint64(offset + rng.start),
+			End:   uint64(offset + rng.end - 1),
+		}
+
+		err = retry(ctx, uploadAttempts, func() error {
+			return b.WriteRange(wr, bytes.NewReader(buf[rng.start:rng.end]), nil)
+		})
+		if err != nil {
+			return sent, fmt.Errorf("writing %s: %v", wr, err)
+		}
+
+		sent += rng.end - rng.start
+	}
+
+	return sent, nil
+}
+
+// overlaps returns true if any of the sorted page ranges intersect the byte
+// range [start, end).
+func overlaps(ranges []storage.PageRange, start, end int64) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End >= start })
+	return i < len(ranges) && ranges[i].Start < end
+}
+
+// retry calls f up to attempts times with exponential backoff while it fails
+// with a transient error, returning the last error if no call succeeds. The
+// backoff is cut short if ctx is cancelled.
+func retry(ctx context.Context, attempts int, f func() error) (err error) {
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			log.Printf("retrying after error: %v", err)
+			select {
+			case <-time.After(retryDelay << uint(i-1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = f()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// isTransient returns true if err is worth retrying: that is, no response was
+// received. The storage client itself retries responses with 408 and 5xx
+// statuses (see storage.DefaultSender), so an error status reaching here has
+// either been retried already or, like 400 or 403, will not go away.
+func isTransient(err error) bool {
+	switch err.(type) {
+	case storage.AzureStorageServiceError, storage.UnexpectedStatusCodeError:
+		return false
+	}
+	return true
+}
+
+// byteRange is a half-open range of byte offsets [start, end).
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// appendPage adds the 512 byte page at offset i to ranges, extending the last
+// range if it is adjacent.
+func appendPage(ranges []byteRange, i int) []byteRange {
+	if len(ranges) > 0 && ranges[len(ranges)-1].end == int64(i) {
+		ranges[len(ranges)-1].end += 512
+		return ranges
+	}
+
+	return append(ranges, byteRange{start: int64(i), end: int64(i) + 512})
+}
+
+// pageRanges returns the runs of 512 byte pages in buf which hold data and
+// those which are entirely zero. len(buf) must be a multiple of 512.
+func pageRanges(buf []byte) (data, zero []byteRange) {
+	for i := 0; i < len(buf); i += 512 {
+		if bytes.Equal(buf[i:i+512], zeroPage) {
+			zero = appendPage(zero, i)
+		} else {
+			data = appendPage(data, i)
+		}
+	}
+
+	return data, zero
+}
@@ -0,0 +1,528 @@
+package imagecreate
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakePageBlobService is a local stand-in for the blob service holding a
+// single page blob. It records the calls which modify the blob.
+type fakePageBlobService struct {
+	mu sync.Mutex
+
+	data    []byte // nil if the blob does not exist
+	pages   []bool // whether each 512 byte page has been written
+	version int    // incremented on each change, for the ETag
+
+	creates int
+	writes  []string
+	clears  []string
+
+	// failures is the number of times a Put Page call for a given x-ms-range
+	// fails before succeeding, with failStatus or, if it is zero, by dropping
+	// the connection.
+	failures   map[string]int
+	failStatus int
+	attempts   map[string]int
+}
+
+func newFakePageBlobService() *fakePageBlobService {
+	return &fakePageBlobService{
+		failures: map[string]int{},
+		attempts: map[string]int{},
+	}
+}
+
+// create replaces the blob with an empty page blob of the given size.
+func (s *fakePageBlobService) create(size int64) {
+	s.data = make([]byte, size)
+	s.pages = make([]bool, size/512)
+	s.version++
+}
+
+// put writes p to the blob at offset, marking the pages as written.
+func (s *fakePageBlobService) put(p []byte, offset int64) {
+	copy(s.data[offset:], p)
+	for i := offset / 512; i < (offset+int64(len(p)))/512; i++ {
+		s.pages[i] = true
+	}
+	s.version++
+}
+
+func parseRange(h string) (start, end int64, err error) {
+	_, err = fmt.Sscanf(h, "bytes=%d-%d", &start, &end)
+	return
+}
+
+func (s *fakePageBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodHead:
+		if s.data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("x-ms-blob-type", string(storage.BlobTypePage))
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		w.Header().Set("Etag", fmt.Sprintf(`"%d"`, s.version))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "":
+		size, err := strconv.ParseInt(r.Header.Get("x-ms-blob-content-length"), 10, 64)
+		if err != nil || r.Header.Get("x-ms-blob-type") != string(storage.BlobTypePage) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.creates++
+		s.create(size)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "page":
+		rng := r.Header.Get("x-ms-range")
+		s.attempts[rng]++
+		if s.failures[rng] > 0 {
+			s.failures[rng]--
+			if s.failStatus != 0 {
+				w.WriteHeader(s.failStatus)
+				return
+			}
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+
+		start, end, err := parseRange(rng)
+		if err != nil || start%512 != 0 || (end+1)%512 != 0 || end >= int64(len(s.data)) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		switch r.Header.Get("x-ms-page-write") {
+		case "update":
+			p, err := ioutil.ReadAll(r.Body)
+			if err != nil || int64(len(p)) != end-start+1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.writes = append(s.writes, rng)
+			s.put(p, start)
+
+		case "clear":
+			s.clears = append(s.clears, rng)
+			copy(s.data[start:end+1], make([]byte, end-start+1))
+			for i := start / 512; i <= end/512; i++ {
+				s.pages[i] = false
+			}
+			s.version++
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "pagelist":
+		var resp storage.GetPageRangesResponse
+		for i, written := range s.pages {
+			if !written {
+				continue
+			}
+			start := int64(i) * 512
+			if n := len(resp.PageList); n > 0 && resp.PageList[n-1].End == start-1 {
+				resp.PageList[n-1].End += 512
+			} else {
+				resp.PageList = append(resp.PageList, storage.PageRange{Start: start, End: start + 511})
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		xml.NewEncoder(w).Encode(&resp)
+
+	case r.Method == http.MethodGet && r.Header.Get("Range") != "":
+		start, end, err := parseRange(r.Header.Get("Range"))
+		if err != nil || end >= int64(len(s.data)) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		p := s.data[start : end+1]
+		if r.Header.Get("x-ms-range-get-content-md5") == "true" {
+			sum := md5.Sum(p)
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(p)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// newTestBlob starts s and returns a reference to its blob. The client
+// connects to s whatever the host in the request URL.
+func newTestBlob(t *testing.T, s *fakePageBlobService) *storage.Blob {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	client, err := storage.NewClient("testaccount", base64.StdEncoding.EncodeToString([]byte("key")), "core.test", storage.DefaultAPIVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+		},
+	}
+
+	bsc := client.GetBlobService()
+	return bsc.GetContainerReference("vhds").GetBlobReference("disk.vhd")
+}
+
+// testDisk returns a disk of two and a bit chunks: the first two with runs of
+// data separated by zero pages, including a run crossing the chunk boundary,
+// and the last with one page of data. The Put Page ranges expected to upload
+// it to a new blob are also returned.
+func testDisk() ([]byte, []string) {
+	disk := make([]byte, 2*maxPageRangeSize+4096)
+	fill := func(start, end int64) {
+		for i := start; i < end; i++ {
+			disk[i] = byte(i%251 + 1)
+		}
+	}
+	rng := func(start, end int64) string {
+		return fmt.Sprintf("bytes=%d-%d", start, end-1)
+	}
+
+	fill(0, 1024)
+	fill(4096, 8192)
+	fill(maxPageRangeSize-512, maxPageRangeSize+512)
+	fill(2*maxPageRangeSize+512, 2*maxPageRangeSize+1024)
+
+	return disk, []string{
+		rng(0, 1024),
+		rng(4096, 8192),
+		rng(maxPageRangeSize-512, maxPageRangeSize),
+		rng(maxPageRangeSize, maxPageRangeSize+512),
+		rng(2*maxPageRangeSize+512, 2*maxPageRangeSize+1024),
+	}
+}
+
+func sorted(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
+
+func TestUploadPageBlob(t *testing.T) {
+	disk, writes := testDisk()
+
+	s := newFakePageBlobService()
+	b := newTestBlob(t, s)
+
+	sent, contentMD5, err := uploadPageBlob(context.Background(), b, bytes.NewReader(disk), int64(len(disk)), 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.creates != 1 {
+		t.Errorf("got %d Put Blob calls, expected 1", s.creates)
+	}
+	if !reflect.DeepEqual(sorted(s.writes), sorted(writes)) {
+		t.Errorf("got writes %v, expected %v", sorted(s.writes), sorted(writes))
+	}
+	if len(s.clears) != 0 {
+		t.Errorf("got clears %v, expected none", s.clears)
+	}
+	if sent != 6656 {
+		t.Errorf("sent %d bytes, expected 6656", sent)
+	}
+	if !bytes.Equal(s.data, disk) {
+		t.Error("uploaded blob differs from disk")
+	}
+	sum := md5.Sum(disk)
+	if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("got content MD5 %q, expected that of the disk", contentMD5)
+	}
+}
+
+func TestUploadPageBlobInvalidSize(t *testing.T) {
+	s := newFakePageBlobService()
+	b := newTestBlob(t, s)
+
+	_, _, err := uploadPageBlob(context.Background(), b, bytes.NewReader(make([]byte, 1000)), 1000, 1, false)
+	if err == nil {
+		t.Error("expected error")
+	}
+	if s.creates != 0 {
+		t.Errorf("got %d Put Blob calls, expected none", s.creates)
+	}
+}
+
+func TestUploadPageBlobRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	disk, writes := testDisk()
+
+	for _, tt := range []struct {
+		name         string
+		failures     int
+		failStatus   int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "transient", failures: uploadAttempts - 1, wantAttempts: uploadAttempts},
+		{name: "persistent", failures: uploadAttempts, wantErr: true, wantAttempts: uploadAttempts},
+		{name: "client error", failures: 1, failStatus: http.StatusForbidden, wantErr: true, wantAttempts: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakePageBlobService()
+			s.failures[writes[1]] = tt.failures
+			s.failStatus = tt.failStatus
+			b := newTestBlob(t, s)
+
+			_, _, err := uploadPageBlob(context.Background(), b, bytes.NewReader(disk), int64(len(disk)), 4, false)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// A dropped connection does not order the handler before
+			// the client as far as the race detector is concerned.
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.attempts[writes[1]] != tt.wantAttempts {
+				t.Errorf("range %s tried %d times, expected %d", writes[1], s.attempts[writes[1]], tt.wantAttempts)
+			}
+			for _, rng := range writes {
+				if rng != writes[1] && s.attempts[rng] > 1 {
+					t.Errorf("range %s tried %d times, expected 1", rng, s.attempts[rng])
+				}
+			}
+			if !tt.wantErr && !bytes.Equal(s.data, disk) {
+				t.Error("uploaded blob differs from disk")
+			}
+		})
+	}
+}
+
+func TestUploadPageBlobCancel(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Hour
+
+	disk, writes := testDisk()
+
+	s := newFakePageBlobService()
+	s.failures[writes[1]] = 1
+	b := newTestBlob(t, s)
+
+	// The upload waits to retry a dropped write until it is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := uploadPageBlob(ctx, b, bytes.NewReader(disk), int64(len(disk)), 1, false)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload was not cancelled")
+	}
+}
+
+func TestUploadPageBlobResume(t *testing.T) {
+	disk, writes := testDisk()
+
+	s := newFakePageBlobService()
+	s.create(int64(len(disk)))
+
+	// The first chunk is already complete. The second holds the right data
+	// and a stray page which must be cleared. The third is missing.
+	s.put(disk[:maxPageRangeSize], 0)
+	s.put(disk[maxPageRangeSize:maxPageRangeSize+512], maxPageRangeSize)
+	s.put(bytes.Repeat([]byte{0xff}, 512), maxPageRangeSize+8192)
+
+	b := newTestBlob(t, s)
+
+	sent, _, err := uploadPageBlob(context.Background(), b, bytes.NewReader(disk), int64(len(disk)), 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.creates != 0 {
+		t.Errorf("got %d Put Blob calls, expected none", s.creates)
+	}
+	if !reflect.DeepEqual(sorted(s.writes), sorted(writes[3:])) {
+		t.Errorf("got writes %v, expected %v", sorted(s.writes), sorted(writes[3:]))
+	}
+	clears := []string{fmt.Sprintf("bytes=%d-%d", maxPageRangeSize+512, 2*maxPageRangeSize-1)}
+	if !reflect.DeepEqual(s.clears, clears) {
+		t.Errorf("got clears %v, expected %v", s.clears, clears)
+	}
+	if sent != 1024 {
+		t.Errorf("sent %d bytes, expected 1024", sent)
+	}
+	if !bytes.Equal(s.data, disk) {
+		t.Error("uploaded blob differs from disk")
+	}
+}
+
+func TestUploadPageBlobResumeWrongSize(t *testing.T) {
+	disk, writes := testDisk()
+
+	s := newFakePageBlobService()
+	s.create(int64(len(disk)) + 512)
+	s.put(bytes.Repeat([]byte{0xff}, 512), 0)
+
+	b := newTestBlob(t, s)
+
+	_, _, err := uploadPageBlob(context.Background(), b, bytes.NewReader(disk), int64(len(disk)), 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.creates != 1 {
+		t.Errorf("got %d Put Blob calls, expected 1", s.creates)
+	}
+	if !reflect.DeepEqual(sorted(s.writes), sorted(writes)) {
+		t.Errorf("got writes %v, expected %v", sorted(s.writes), sorted(writes))
+	}
+	if !bytes.Equal(s.data, disk) {
+		t.Error("uploaded blob differs from disk")
+	}
+}
+
+func TestImageCreatorUpload(t *testing.T) {
+	f, err := ioutil.TempFile("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	raw := bytes.Repeat([]byte{1}, vhdAlignment)
+	_, err = f.Write(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newFakePageBlobService()
+	b := newTestBlob(t, s)
+
+	c := &ImageCreator{
+		Options: Options{
+			Source:      "https://testaccount.blob.core.test/vhds/disk.vhd",
+			File:        f.Name(),
+			Format:      FormatRaw,
+			Concurrency: 1,
+		},
+		Blob: func(ctx context.Context, blobURL string) (*storage.Blob, error) {
+			return b, nil
+		},
+	}
+
+	var src diskSource
+	err = c.upload(context.Background(), &src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(s.data)) != vhdAlignment+vhdFooterSize {
+		t.Fatalf("uploaded %d bytes, expected %d", len(s.data), vhdAlignment+vhdFooterSize)
+	}
+	if !bytes.Equal(s.data[:vhdAlignment], raw) {
+		t.Error("uploaded blob differs from disk")
+	}
+	if !bytes.Equal(s.data[vhdAlignment:vhdAlignment+len(vhdCookie)], vhdCookie[:]) {
+		t.Error("uploaded blob has no VHD footer")
+	}
+
+	sum := md5.Sum(s.data)
+	if src.contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("got content MD5 %q, expected that of the uploaded blob", src.contentMD5)
+	}
+	if src.etag != fmt.Sprintf(`"%d"`, s.version) {
+		t.Errorf("got ETag %q, expected %q", src.etag, fmt.Sprintf(`"%d"`, s.version))
+	}
+
+	// An image created from the upload needs no further upload.
+	existing := &compute.Image{Tags: ProvenanceTags(c.Source, src.etag, src.contentMD5)}
+	writes := len(s.writes)
+
+	var again diskSource
+	err = c.upload(context.Background(), &again, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.creates != 1 || len(s.writes) != writes {
+		t.Error("unchanged disk was uploaded again")
+	}
+	if again != src {
+		t.Errorf("got source %+v, expected %+v", again, src)
+	}
+
+	// If the blob has changed since, the same contents are uploaded again
+	// without needing force.
+	existing.Tags[TagSourceETag] = to.StringPtr(`"other"`)
+
+	err = c.upload(context.Background(), &again, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.creates != 2 {
+		t.Error("changed blob was not uploaded again")
+	}
+	if again.contentMD5 != src.contentMD5 {
+		t.Errorf("got content MD5 %q, expected %q", again.contentMD5, src.contentMD5)
+	}
+	writes = len(s.writes)
+
+	// Different contents are refused before uploading, unless forced.
+	existing.Tags[TagSourceMD5] = to.StringPtr("other")
+
+	err = c.upload(context.Background(), &again, existing)
+	if err == nil {
+		t.Error("expected error")
+	}
+	if s.creates != 2 || len(s.writes) != writes {
+		t.Error("changed disk was uploaded without force")
+	}
+
+	c.Force = true
+	err = c.upload(context.Background(), &again, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.creates != 3 {
+		t.Error("changed disk was not uploaded with force")
+	}
+}
@@ -0,0 +1,253 @@
+package imagecreate
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// vhdFooterSize is the size of the footer which terminates every VHD.
+const vhdFooterSize = 512
+
+// vhdAlignment is the alignment Azure requires of a VHD's virtual size.
+const vhdAlignment = 1024 * 1024
+
+// Largest virtual sizes Azure accepts for OS and data disk VHDs.
+const (
+	MaxOSDiskSize   = 4095 * 1024 * 1024 * 1024
+	MaxDataDiskSize = 32767 * 1024 * 1024 * 1024
+)
+
+// VHD disk types.
+const (
+	vhdDiskTypeFixed        = 2
+	vhdDiskTypeDynamic      = 3
+	vhdDiskTypeDifferencing = 4
+)
+
+var vhdCookie = [8]byte{'c', 'o', 'n', 'e', 'c', 't', 'i', 'x'}
+
+// vhdEpoch is the origin of the VHD footer timestamp.
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdFooter is the on-disk (big endian) VHD footer. See "Virtual Hard Disk
+// Image Format Specification", Microsoft, October 2006.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// newFixedVHDFooter returns a footer for a fixed VHD of the given virtual size,
+// converted from a disk image last modified at modTime. The time stamp and
+// unique ID are derived from these, so that converting the same image twice
+// gives the same VHD.
+func newFixedVHDFooter(size int64, modTime time.Time) *vhdFooter {
+	f := &vhdFooter{
+		Cookie:             vhdCookie,
+		Features:           2,
+		FileFormatVersion:  0x00010000,
+		DataOffset:         0xffffffffffffffff,
+		TimeStamp:          uint32(modTime.Sub(vhdEpoch) / time.Second),
+		CreatorApplication: [4]byte{'a', 'i', 'c', ' '},
+		CreatorVersion:     0x00010000,
+		CreatorHostOS:      [4]byte{'W', 'i', '2', 'k'},
+		OriginalSize:       uint64(size),
+		CurrentSize:        uint64(size),
+		DiskType:           vhdDiskTypeFixed,
+	}
+
+	f.Cylinders, f.Heads, f.SectorsPerTrack = vhdGeometry(size)
+	f.UniqueID = md5.Sum([]byte(fmt.Sprintf("%d %d", size, modTime.UnixNano())))
+	f.Checksum = f.checksum()
+
+	return f
+}
+
+// vhdGeometry returns the CHS geometry for a disk of the given size, using
+// the algorithm given in the VHD specification.
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / 512
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var h, spt, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+
+		h = (cylinderTimesHeads + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+
+		if cylinderTimesHeads >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+
+		if cylinderTimesHeads >= h*1024 {
+			spt = 63
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+
+	return uint16(cylinderTimesHeads / h), uint8(h), uint8(spt)
+}
+
+// checksum returns the ones' complement of the sum of the bytes of the
+// footer, excluding the checksum field itself.
+func (f *vhdFooter) checksum() uint32 {
+	g := *f
+	g.Checksum = 0
+
+	var sum uint32
+	for _, b := range g.bytes() {
+		sum += uint32(b)
+	}
+
+	return ^sum
+}
+
+// validateVHD reads the footer of the VHD of the given size held in r and
+// checks that Azure will accept it as an image disk of at most maxSize bytes.
+func validateVHD(r io.ReaderAt, size, maxSize int64) error {
+	if size < vhdFooterSize {
+		return fmt.Errorf("size %d is too small to hold a VHD footer", size)
+	}
+
+	var f vhdFooter
+	err := binary.Read(io.NewSectionReader(r, size-vhdFooterSize, vhdFooterSize), binary.BigEndian, &f)
+	if err != nil {
+		return err
+	}
+
+	if f.Cookie != vhdCookie {
+		return errors.New("no VHD footer found: expected a fixed VHD")
+	}
+
+	if f.Checksum != f.checksum() {
+		return fmt.Errorf("VHD footer checksum %#08x does not match computed checksum %#08x", f.Checksum, f.checksum())
+	}
+
+	switch f.DiskType {
+	case vhdDiskTypeFixed:
+	case vhdDiskTypeDynamic:
+		return errors.New("dynamic VHDs are not supported: convert to a fixed VHD")
+	case vhdDiskTypeDifferencing:
+		return errors.New("differencing VHDs are not supported: convert to a fixed VHD")
+	default:
+		return fmt.Errorf("invalid VHD disk type %d", f.DiskType)
+	}
+
+	if int64(f.CurrentSize) != size-vhdFooterSize {
+		return fmt.Errorf("VHD footer size %d does not match data size %d", f.CurrentSize, size-vhdFooterSize)
+	}
+
+	if f.CurrentSize%vhdAlignment != 0 {
+		return fmt.Errorf("VHD size %d is not a multiple of 1MiB", f.CurrentSize)
+	}
+
+	if int64(f.CurrentSize) > maxSize {
+		return fmt.Errorf("VHD size %d exceeds maximum of %d", f.CurrentSize, maxSize)
+	}
+
+	return nil
+}
+
+func (f *vhdFooter) bytes() []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, f)
+	return buf.Bytes()
+}
+
+// fixedVHD presents the first size bytes of r as a fixed VHD, padding with
+// zeros to vhdAlignment and appending a footer.
+type fixedVHD struct {
+	r      io.ReaderAt
+	size   int64
+	padded int64
+	footer []byte
+}
+
+func newFixedVHD(r io.ReaderAt, size int64, modTime time.Time) *fixedVHD {
+	padded := (size + vhdAlignment - 1) / vhdAlignment * vhdAlignment
+
+	return &fixedVHD{
+		r:      r,
+		size:   size,
+		padded: padded,
+		footer: newFixedVHDFooter(padded, modTime).bytes(),
+	}
+}
+
+// Size returns the size of the VHD, including its footer.
+func (v *fixedVHD) Size() int64 {
+	return v.padded + vhdFooterSize
+}
+
+func (v *fixedVHD) ReadAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		var m int
+		switch {
+		case off < v.size:
+			l := int64(len(p))
+			if l > v.size-off {
+				l = v.size - off
+			}
+			m, err = v.r.ReadAt(p[:l], off)
+			if m == int(l) {
+				err = nil
+			}
+
+		case off < v.padded:
+			l := int64(len(p))
+			if l > v.padded-off {
+				l = v.padded - off
+			}
+			zero(p[:l])
+			m = int(l)
+
+		case off < v.padded+vhdFooterSize:
+			m = copy(p, v.footer[off-v.padded:])
+
+		default:
+			return n, io.EOF
+		}
+
+		n += m
+		off += int64(m)
+		p = p[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,96 @@
+package imagecreate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVHDGeometry(t *testing.T) {
+	for _, tt := range []struct {
+		size            int64
+		cylinders       uint16
+		heads           uint8
+		sectorsPerTrack uint8
+	}{
+		{size: 10 << 20, cylinders: 301, heads: 4, sectorsPerTrack: 17},
+		{size: 1 << 30, cylinders: 2080, heads: 16, sectorsPerTrack: 63},
+		{size: 64 << 30, cylinders: 32896, heads: 16, sectorsPerTrack: 255},
+		{size: 4 << 40, cylinders: 65535, heads: 16, sectorsPerTrack: 255},
+	} {
+		c, h, s := vhdGeometry(tt.size)
+		if c != tt.cylinders || h != tt.heads || s != tt.sectorsPerTrack {
+			t.Errorf("%d: got %d/%d/%d, expected %d/%d/%d", tt.size, c, h, s, tt.cylinders, tt.heads, tt.sectorsPerTrack)
+		}
+	}
+}
+
+func TestVHDFooterRoundTrip(t *testing.T) {
+	modTime := time.Date(2018, time.June, 1, 0, 0, 0, 0, time.UTC)
+	f := newFixedVHDFooter(vhdAlignment, modTime)
+
+	b := f.bytes()
+	if len(b) != vhdFooterSize {
+		t.Fatalf("footer is %d bytes, expected %d", len(b), vhdFooterSize)
+	}
+
+	var g vhdFooter
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, &g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != *f {
+		t.Error("footer differs after round trip")
+	}
+	if g.Checksum != g.checksum() {
+		t.Errorf("checksum %#08x does not match computed checksum %#08x", g.Checksum, g.checksum())
+	}
+
+	if h := newFixedVHDFooter(vhdAlignment, modTime); *h != *f {
+		t.Error("footers for the same image differ")
+	}
+	if h := newFixedVHDFooter(vhdAlignment, modTime.Add(time.Second)); h.UniqueID == f.UniqueID {
+		t.Error("footers for different images have the same unique ID")
+	}
+}
+
+func TestFixedVHD(t *testing.T) {
+	raw := bytes.Repeat([]byte{1}, 1000)
+	v := newFixedVHD(bytes.NewReader(raw), int64(len(raw)), time.Now())
+
+	if v.Size() != vhdAlignment+vhdFooterSize {
+		t.Fatalf("got size %d, expected %d", v.Size(), vhdAlignment+vhdFooterSize)
+	}
+
+	err := validateVHD(v, v.Size(), MaxOSDiskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(io.NewSectionReader(v, 0, v.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:len(raw)], raw) {
+		t.Error("VHD data differs from image")
+	}
+	if !bytes.Equal(b[len(raw):vhdAlignment], make([]byte, vhdAlignment-len(raw))) {
+		t.Error("VHD padding is not zero")
+	}
+
+	// Corrupting the footer is detected.
+	b[len(b)-1] ^= 0xff
+	err = validateVHD(bytes.NewReader(b), int64(len(b)), MaxOSDiskSize)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("got error %v, expected checksum mismatch", err)
+	}
+
+	err = validateVHD(v, v.Size(), vhdAlignment-1)
+	if err == nil {
+		t.Error("expected error for VHD exceeding maximum size")
+	}
+}
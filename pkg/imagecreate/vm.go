@@ -0,0 +1,160 @@
+package imagecreate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Instance view status codes of interest.
+const (
+	statusPowerStateDeallocated = "PowerState/deallocated"
+	statusOSStateGeneralized    = "OSState/generalized"
+)
+
+// prepareSourceVM returns the named VM (or VM resource ID), checking that it is
+// deallocated and generalized and so can be captured as an image. If
+// deallocate or generalize are set, the VM is first brought into the required
+// state. Generalizing requires deallocation. Note that the guest OS must
+// already have been deprovisioned (e.g. with `waagent -deprovision` or
+// sysprep) before the VM is generalized. If dryRun is set, the VM is left
+// unchanged. A VM named by resource ID may be in another subscription than
+// that of vcli.
+func prepareSourceVM(ctx context.Context, vcli compute.VirtualMachinesClient, resourceGroup, s string, deallocate, generalize, dryRun bool) (*compute.VirtualMachine, error) {
+	name := s
+	if strings.HasPrefix(s, "/") {
+		r, err := azure.ParseResourceID(s)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(r.Provider, "Microsoft.Compute") || !strings.EqualFold(r.ResourceType, "virtualMachines") {
+			return nil, fmt.Errorf("%s: expected a virtual machine resource ID", s)
+		}
+		vcli.SubscriptionID, resourceGroup, name = r.SubscriptionID, r.ResourceGroup, r.ResourceName
+	}
+
+	vm, err := vcli.Get(ctx, resourceGroup, name, compute.InstanceView)
+	if err != nil {
+		return nil, err
+	}
+
+	deallocated, generalized := vmState(&vm)
+
+	if !deallocated {
+		if !deallocate && !generalize {
+			return nil, fmt.Errorf("virtual machine %s is not deallocated: rerun with --deallocate", name)
+		}
+
+		if dryRun {
+			log.Printf("would deallocate virtual machine %s", name)
+		} else {
+			err = deallocateVM(ctx, vcli, resourceGroup, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !generalized {
+		if !generalize {
+			return nil, fmt.Errorf("virtual machine %s is not generalized: deprovision the guest OS and rerun with --generalize", name)
+		}
+
+		if dryRun {
+			log.Printf("would generalize virtual machine %s", name)
+		} else {
+			log.Printf("generalizing virtual machine %s", name)
+			_, err = vcli.Generalize(ctx, resourceGroup, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &vm, nil
+}
+
+func deallocateVM(ctx context.Context, vcli compute.VirtualMachinesClient, resourceGroup, name string) error {
+	log.Printf("deallocating virtual machine %s", name)
+	future, err := vcli.Deallocate(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, vcli.Client)
+}
+
+// vmState returns whether the VM's instance view reports it as deallocated
+// and generalized.
+func vmState(vm *compute.VirtualMachine) (deallocated, generalized bool) {
+	if vm.VirtualMachineProperties == nil || vm.InstanceView == nil || vm.InstanceView.Statuses == nil {
+		return
+	}
+
+	for _, status := range *vm.InstanceView.Statuses {
+		if status.Code == nil {
+			continue
+		}
+
+		switch *status.Code {
+		case statusPowerStateDeallocated:
+			deallocated = true
+		case statusOSStateGeneralized:
+			generalized = true
+		}
+	}
+
+	return
+}
+
+// vmStorageProfile returns an image storage profile referencing the disks of
+// vm, so that storageAccountType can be applied to them.
+func vmStorageProfile(vm *compute.VirtualMachine, storageAccountType compute.StorageAccountTypes) (*compute.ImageStorageProfile, error) {
+	if vm.StorageProfile == nil || vm.StorageProfile.OsDisk == nil {
+		return nil, fmt.Errorf("virtual machine %s has no OS disk", *vm.Name)
+	}
+
+	osDisk := vm.StorageProfile.OsDisk
+	sp := &compute.ImageStorageProfile{
+		OsDisk: &compute.ImageOSDisk{
+			OsType:             osDisk.OsType,
+			OsState:            compute.Generalized,
+			Caching:            osDisk.Caching,
+			StorageAccountType: storageAccountType,
+		},
+	}
+
+	switch {
+	case osDisk.ManagedDisk != nil:
+		sp.OsDisk.ManagedDisk = &compute.SubResource{ID: osDisk.ManagedDisk.ID}
+	case osDisk.Vhd != nil:
+		sp.OsDisk.BlobURI = osDisk.Vhd.URI
+	}
+
+	if vm.StorageProfile.DataDisks != nil {
+		dataDisks := make([]compute.ImageDataDisk, 0, len(*vm.StorageProfile.DataDisks))
+		for _, dataDisk := range *vm.StorageProfile.DataDisks {
+			d := compute.ImageDataDisk{
+				Lun:                dataDisk.Lun,
+				Caching:            dataDisk.Caching,
+				StorageAccountType: storageAccountType,
+			}
+
+			switch {
+			case dataDisk.ManagedDisk != nil:
+				d.ManagedDisk = &compute.SubResource{ID: dataDisk.ManagedDisk.ID}
+			case dataDisk.Vhd != nil:
+				d.BlobURI = dataDisk.Vhd.URI
+			}
+
+			dataDisks = append(dataDisks, d)
+		}
+		sp.DataDisks = &dataDisks
+	}
+
+	return sp, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// publishTarget is the parsed form of a `--publish-target` flag.
+type publishTarget struct {
+	subscriptionID string
+	resourceGroup  string
+	location       string
+	storageAccount string
+}
+
+// parsePublishTarget parses a comma separated list of key=value pairs
+// describing a publish target. resource-group and storage-account are
+// required; subscription defaults to defaultSubscriptionID.
+func parsePublishTarget(s, defaultSubscriptionID string) (*publishTarget, error) {
+	t := &publishTarget{subscriptionID: defaultSubscriptionID}
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: expected key=value, found %q", s, kv)
+		}
+
+		switch parts[0] {
+		case "subscription":
+			t.subscriptionID = parts[1]
+		case "resource-group":
+			t.resourceGroup = parts[1]
+		case "location":
+			t.location = parts[1]
+		case "storage-account":
+			t.storageAccount = parts[1]
+		default:
+			return nil, fmt.Errorf("%s: unknown key %q", s, parts[0])
+		}
+	}
+
+	if t.subscriptionID == "" {
+		return nil, fmt.Errorf("%s: subscription is required", s)
+	}
+	if t.resourceGroup == "" {
+		return nil, fmt.Errorf("%s: resource-group is required", s)
+	}
+	if t.storageAccount == "" {
+		return nil, fmt.Errorf("%s: storage-account is required", s)
+	}
+
+	return t, nil
+}
+
+// publish creates the image `--name` from the VHD at `--source` in each of
+// the `--publish-target`s, up to `--parallelism` at a time; see
+// publishToTarget. A failure in one target does not affect the others; a table
+// of results is printed once all targets are done.
+func publish() error {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
+	osDisk, err := imageOSDisk()
+	if err != nil {
+		return err
+	}
+	if osDisk.OsType == "" {
+		return fmt.Errorf("--os-type is required")
+	}
+
+	if !imagecreate.IsBlobURL(*source) {
+		return fmt.Errorf("--source must be a blob URL")
+	}
+
+	userTags, err := parseTags(*tags)
+	if err != nil {
+		return err
+	}
+	if *parallelism < 1 {
+		return fmt.Errorf("invalid parallelism %d", *parallelism)
+	}
+
+	env, subscriptionID, authorizer, err := authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]*publishTarget, 0, len(*publishTargets))
+	for _, flag := range *publishTargets {
+		t, err := parsePublishTarget(flag, subscriptionID)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one --publish-target is required")
+	}
+
+	if !*skipPermissionCheck {
+		err = checkPublishPermissions(ctx, env, authorizer, subscriptionID, targets)
+		if err != nil {
+			return err
+		}
+	}
+
+	sourceURL, sourceMD5, err := readableBlobURL(ctx, env, authorizer, subscriptionID, *source)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, *parallelism)
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *publishTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			errs[i] = publishToTarget(ctx, env, authorizer, t, *osDisk, sourceURL, sourceMD5, userTags)
+			if errs[i] != nil {
+				log.Printf("publishing to %s/%s: %v", t.subscriptionID, t.resourceGroup, errs[i])
+			}
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBSCRIPTION\tRESOURCE GROUP\tLOCATION\tRESULT")
+	for i, t := range targets {
+		result := "succeeded"
+		if errs[i] != nil {
+			failed++
+			result = "failed: " + errs[i].Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.subscriptionID, t.resourceGroup, t.location, result)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets failed", failed, len(targets))
+	}
+
+	return nil
+}
+
+// checkPublishPermissions checks that the caller can read `--source` and
+// publish to each of targets.
+func checkPublishPermissions(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID string, targets []*publishTarget) error {
+	u, err := url.Parse(*source)
+	if err != nil {
+		return err
+	}
+
+	// A SAS URL is read without the storage account key.
+	if u.RawQuery == "" {
+		err = imagecreate.CheckPermissions(ctx, env, authorizer, subscriptionID, []imagecreate.Requirement{
+			{StorageAccount: strings.SplitN(u.Host, ".", 2)[0], Actions: []string{imagecreate.ActionListStorageKeys}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range targets {
+		rg := imagecreate.Requirement{
+			ResourceGroup: t.resourceGroup,
+			Actions:       []string{imagecreate.ActionWriteImage},
+		}
+		if t.location == "" {
+			rg.Actions = append(rg.Actions, imagecreate.ActionReadResourceGroup)
+		}
+
+		err = imagecreate.CheckPermissions(ctx, env, authorizer, t.subscriptionID, []imagecreate.Requirement{
+			rg,
+			{StorageAccount: t.storageAccount, Actions: []string{imagecreate.ActionListStorageKeys}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readableBlobURL returns a URL from which the storage service can copy the
+// blob at s, and the base64 MD5 of its contents if known. If s already carries
+// a query string it is assumed to be a SAS URL and is returned unchanged;
+// otherwise the blob is validated and a read SAS is generated for it using the
+// storage account key.
+func readableBlobURL(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, subscriptionID, s string) (string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.RawQuery != "" {
+		return s, "", nil
+	}
+
+	props, err := imagecreate.ValidateBlob(ctx, env, authorizer, subscriptionID, s, imagecreate.MaxOSDiskSize)
+	if err != nil {
+		return "", "", err
+	}
+
+	b, err := imagecreate.GetBlob(ctx, env, authorizer, subscriptionID, s)
+	if err != nil {
+		return "", "", err
+	}
+
+	sasURL, err := b.GetSASURI(storage.BlobSASOptions{
+		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{
+			Read: true,
+		},
+		SASOptions: storage.SASOptions{
+			Expiry:   time.Now().Add(exportAccessDuration),
+			UseHTTPS: true,
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return sasURL, props.ContentMD5, nil
+}
+
+// publishToTarget copies the VHD at sourceURL, whose base64 MD5 is sourceMD5
+// if known, to `--target-container` in t's storage account and creates or
+// updates the image `--name` from the copy in t's resource group, as
+// imagecreate.ImageCreator.Create does, with the given tags. If t has no
+// location, it is set to that of the resource group; the storage account must
+// be in it. Before anything is copied, an existing image is checked: see
+// checkPublished.
+func publishToTarget(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer, t *publishTarget, osDisk compute.ImageOSDisk, sourceURL, sourceMD5 string, tags map[string]*string) error {
+	if t.location == "" {
+		rcli := resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, t.subscriptionID)
+		rcli.Authorizer = authorizer
+
+		group, err := rcli.Get(ctx, t.resourceGroup)
+		if err != nil {
+			return err
+		}
+		t.location = *group.Location
+	}
+
+	err := imagecreate.CheckStorageAccountLocation(ctx, env, authorizer, t.subscriptionID, t.storageAccount, t.location)
+	if err != nil {
+		return err
+	}
+
+	blobURL := imagecreate.BlobURL(env, t.storageAccount, *targetContainer, *name+".vhd")
+
+	opts := imagecreate.Options{
+		ResourceGroup:      t.resourceGroup,
+		Name:               *name,
+		Location:           t.location,
+		Source:             blobURL,
+		OSType:             osDisk.OsType,
+		OSState:            osDisk.OsState,
+		Caching:            osDisk.Caching,
+		StorageAccountType: osDisk.StorageAccountType,
+		Tags:               tags,
+		Force:              *force,
+		DryRun:             *dryRun,
+
+		// The permissions needed for all targets were checked up front.
+		SkipPermissionCheck: true,
+	}
+	if osDisk.DiskSizeGB != nil {
+		opts.DiskSizeGB = *osDisk.DiskSizeGB
+	}
+
+	c := imagecreate.New(env, t.subscriptionID, authorizer, opts)
+
+	b, err := c.Blob(ctx, blobURL)
+	if err != nil {
+		return err
+	}
+
+	current, err := checkPublished(ctx, c, b, sourceMD5)
+	if err != nil {
+		return err
+	}
+
+	if !current {
+		if *dryRun {
+			log.Printf("would copy %s to %s and create image %s in %s/%s from it", *source, blobURL, *name, t.subscriptionID, t.resourceGroup)
+			return nil
+		}
+
+		_, err = b.Container.CreateIfNotExists(&storage.CreateContainerOptions{Access: storage.ContainerAccessTypePrivate})
+		if err != nil {
+			return err
+		}
+
+		err = imagecreate.CopyBlob(ctx, b, sourceURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.Create(ctx)
+	return err
+}
+
+// checkPublished returns true if the image c would create already exists and
+// was created from the blob b, which is its Source, with contents whose base64
+// MD5 is sourceMD5, and b is unchanged since, so that the source need not be
+// copied again. If only b has changed, it is copied again without needing
+// `--force`. If the image was created from other or unknown contents, it is
+// only replaced with `--force`.
+func checkPublished(ctx context.Context, c *imagecreate.ImageCreator, b *storage.Blob, sourceMD5 string) (bool, error) {
+	existing, err := c.Images.Get(ctx, c.ResourceGroup, c.Name, "")
+	switch {
+	case imagecreate.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	if sourceMD5 == "" || !strings.EqualFold(to.String(existing.Tags[imagecreate.TagSource]), c.Source) || to.String(existing.Tags[imagecreate.TagSourceMD5]) != sourceMD5 {
+		if !*force {
+			return false, fmt.Errorf("image %s was created from different or unknown contents: rerun with --force to replace it", c.Name)
+		}
+		return false, nil
+	}
+
+	exists, err := b.Exists()
+	if err != nil || !exists {
+		return false, err
+	}
+
+	err = b.GetProperties(nil)
+	if err != nil {
+		return false, err
+	}
+
+	if b.Properties.Etag != to.String(existing.Tags[imagecreate.TagSourceETag]) {
+		return false, nil
+	}
+
+	log.Printf("not copying %s: image %s in %s/%s was created from the same contents", *source, c.Name, c.SubscriptionID, c.ResourceGroup)
+	return true, nil
+}
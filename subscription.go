@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-06-01/subscriptions"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// resolveSubscription returns the subscription to work in: `--subscription`, else
+// AZURE_SUBSCRIPTION_ID, else the subscriptionId in the SDK auth file named by
+// AZURE_AUTH_LOCATION, checking that it is accessible. If none is set, the
+// subscriptions accessible with authorizer are listed and, if there is exactly
+// one, it is used.
+func resolveSubscription(ctx context.Context, env *azure.Environment, authorizer autorest.Authorizer) (string, error) {
+	scli := subscriptions.NewClientWithBaseURI(env.ResourceManagerEndpoint)
+	scli.Authorizer = authorizer
+
+	id, from := *subscription, "--subscription"
+	if id == "" {
+		id, from = os.Getenv("AZURE_SUBSCRIPTION_ID"), "AZURE_SUBSCRIPTION_ID"
+	}
+	if id == "" && os.Getenv("AZURE_AUTH_LOCATION") != "" {
+		f, err := readAuthFile(os.Getenv("AZURE_AUTH_LOCATION"))
+		if err != nil {
+			return "", err
+		}
+		id, from = f.SubscriptionID, os.Getenv("AZURE_AUTH_LOCATION")
+	}
+
+	if id != "" {
+		s, err := scli.Get(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("subscription %s (from %s) is not accessible: %v", id, from, err)
+		}
+		if s.State != subscriptions.Enabled {
+			log.Printf("warning: subscription %s is %s", id, s.State)
+		}
+		return id, nil
+	}
+
+	var accessible []subscriptions.Subscription
+	it, err := scli.ListComplete(ctx)
+	for ; err == nil && it.NotDone(); err = it.Next() {
+		accessible = append(accessible, it.Value())
+	}
+	if err != nil {
+		return "", fmt.Errorf("listing subscriptions: %v", err)
+	}
+
+	switch len(accessible) {
+	case 0:
+		return "", fmt.Errorf("no subscription is accessible with these credentials")
+	case 1:
+		log.Printf("using subscription %s (%s)", to.String(accessible[0].SubscriptionID), to.String(accessible[0].DisplayName))
+		return to.String(accessible[0].SubscriptionID), nil
+	}
+
+	lines := make([]string, 0, len(accessible))
+	for _, s := range accessible {
+		lines = append(lines, fmt.Sprintf("%s  %s (%s)", to.String(s.SubscriptionID), to.String(s.DisplayName), s.State))
+	}
+	return "", fmt.Errorf("%d subscriptions are accessible: choose one with --subscription or AZURE_SUBSCRIPTION_ID:\n  %s", len(accessible), strings.Join(lines, "\n  "))
+}
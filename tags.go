@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/jim-minter/azure-image-create/pkg/imagecreate"
+)
+
+// parseTags parses the given `--tag` flags, each of the form key=value, which
+// may not set provenance tags.
+func parseTags(flags []string) (map[string]*string, error) {
+	for _, flag := range flags {
+		key := strings.SplitN(flag, "=", 2)[0]
+		if imagecreate.IsProvenanceTag(key) {
+			return nil, fmt.Errorf("%s: tag %s is set automatically and cannot be overridden", flag, key)
+		}
+	}
+
+	return parseMatchTags(flags)
+}
+
+// parseMatchTags parses the given `--match-tag` flags like parseTags, but
+// allows provenance tags to be matched.
+func parseMatchTags(flags []string) (map[string]*string, error) {
+	tags := map[string]*string{}
+
+	for _, flag := range flags {
+		parts := strings.SplitN(flag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s: expected key=value", flag)
+		}
+		if len(parts[1]) > imagecreate.MaxTagValueLength {
+			return nil, fmt.Errorf("%s: value exceeds %d characters", flag, imagecreate.MaxTagValueLength)
+		}
+		if _, found := tags[parts[0]]; found {
+			return nil, fmt.Errorf("duplicate tag %s", parts[0])
+		}
+
+		tags[parts[0]] = to.StringPtr(parts[1])
+	}
+
+	return tags, nil
+}
+
+// nonProvenanceTags returns tags without the provenance tags set by
+// imagecreate.ProvenanceTags.
+func nonProvenanceTags(tags map[string]*string) map[string]*string {
+	result := map[string]*string{}
+	for k, v := range tags {
+		if !imagecreate.IsProvenanceTag(k) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// mergeTags returns the union of the given tag sets, later sets taking
+// precedence.
+func mergeTags(sets ...map[string]*string) map[string]*string {
+	tags := map[string]*string{}
+	for _, set := range sets {
+		for k, v := range set {
+			tags[k] = v
+		}
+	}
+	return tags
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	for _, tt := range []struct {
+		flags   []string
+		wantErr bool
+	}{
+		{flags: []string{"owner=me", "empty="}},
+		{flags: []string{"owner"}, wantErr: true},
+		{flags: []string{"=me"}, wantErr: true},
+		{flags: []string{"owner=me", "owner=you"}, wantErr: true},
+		{flags: []string{"source=https://account.blob.core.windows.net/vhds/other.vhd"}, wantErr: true},
+		{flags: []string{"sourceMD5=x"}, wantErr: true},
+		{flags: []string{"CreatedAt=2000-01-01T00:00:00Z"}, wantErr: true},
+	} {
+		_, err := parseTags(tt.flags)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v", tt.flags, err)
+		}
+	}
+
+	_, err := parseMatchTags([]string{"source=https://account.blob.core.windows.net/vhds/other.vhd"})
+	if err != nil {
+		t.Errorf("matching a provenance tag: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// exportAccessDuration is the lifetime of the read SASs issued for temporary
+// disks, snapshots and published blobs.
+const exportAccessDuration = 24 * time.Hour
+
+// tempDisk is a temporary managed disk or snapshot which is read via a SAS
+// and then deleted.
+type tempDisk interface {
+	grantAccess(ctx context.Context, data compute.GrantAccessData) (string, error)
+	revokeAccess(ctx context.Context) error
+	delete(ctx context.Context) error
+	String() string
+}
+
+// grantReadAccess returns a read SAS URL for d.
+func grantReadAccess(ctx context.Context, d tempDisk) (string, error) {
+	return d.grantAccess(ctx, compute.GrantAccessData{
+		Access:            compute.Read,
+		DurationInSeconds: to.Int32Ptr(int32(exportAccessDuration / time.Second)),
+	})
+}
+
+// revokeReadAccess and deleteTempDisk clean up after grantReadAccess and the
+// creation of d respectively. Errors are logged rather than returned since
+// they are called during cleanup.
+func revokeReadAccess(ctx context.Context, d tempDisk) {
+	err := d.revokeAccess(ctx)
+	if err != nil {
+		log.Printf("revoking access to %s: %v", d, err)
+	}
+}
+
+func deleteTempDisk(ctx context.Context, d tempDisk) {
+	log.Printf("deleting temporary %s", d)
+	err := d.delete(ctx)
+	if err != nil {
+		log.Printf("deleting %s: %v", d, err)
+	}
+}
+
+type tempManagedDisk struct {
+	dcli          compute.DisksClient
+	resourceGroup string
+	name          string
+}
+
+func (d *tempManagedDisk) grantAccess(ctx context.Context, data compute.GrantAccessData) (string, error) {
+	future, err := d.dcli.GrantAccess(ctx, d.resourceGroup, d.name, data)
+	if err != nil {
+		return "", err
+	}
+
+	err = future.WaitForCompletion(ctx, d.dcli.Client)
+	if err != nil {
+		return "", err
+	}
+
+	access, err := future.Result(d.dcli)
+	if err != nil {
+		return "", err
+	}
+
+	return *access.AccessSAS, nil
+}
+
+func (d *tempManagedDisk) revokeAccess(ctx context.Context) error {
+	future, err := d.dcli.RevokeAccess(ctx, d.resourceGroup, d.name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, d.dcli.Client)
+}
+
+func (d *tempManagedDisk) delete(ctx context.Context) error {
+	future, err := d.dcli.Delete(ctx, d.resourceGroup, d.name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, d.dcli.Client)
+}
+
+func (d *tempManagedDisk) String() string {
+	return "disk " + d.name
+}
+
+type tempSnapshot struct {
+	scli          compute.SnapshotsClient
+	resourceGroup string
+	name          string
+}
+
+func (s *tempSnapshot) grantAccess(ctx context.Context, data compute.GrantAccessData) (string, error) {
+	future, err := s.scli.GrantAccess(ctx, s.resourceGroup, s.name, data)
+	if err != nil {
+		return "", err
+	}
+
+	err = future.WaitForCompletion(ctx, s.scli.Client)
+	if err != nil {
+		return "", err
+	}
+
+	access, err := future.Result(s.scli)
+	if err != nil {
+		return "", err
+	}
+
+	return *access.AccessSAS, nil
+}
+
+func (s *tempSnapshot) revokeAccess(ctx context.Context) error {
+	future, err := s.scli.RevokeAccess(ctx, s.resourceGroup, s.name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, s.scli.Client)
+}
+
+func (s *tempSnapshot) delete(ctx context.Context) error {
+	future, err := s.scli.Delete(ctx, s.resourceGroup, s.name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, s.scli.Client)
+}
+
+func (s *tempSnapshot) String() string {
+	return "snapshot " + s.name
+}